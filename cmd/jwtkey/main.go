@@ -0,0 +1,192 @@
+// Command jwtkey manages the signing keys in JWT_KEYS_DIR.
+//
+//	go run ./cmd/jwtkey generate -dir config/keys -alg ES256
+//	go run ./cmd/jwtkey activate -dir config/keys -kid <kid>
+//	go run ./cmd/jwtkey retire -dir config/keys -kid <kid>
+//	go run ./cmd/jwtkey list -dir config/keys
+//
+// Running replicas pick up changes on their next key reload. Generate a key and wait for
+// downstream verifiers to see it before activating it, and only retire the old key once
+// the access tokens it signed have expired.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dir := flags.String("dir", os.Getenv("JWT_KEYS_DIR"), "keys directory")
+	kid := flags.String("kid", "", "key id")
+	alg := flags.String("alg", "ES256", "signing algorithm for new keys (RS256, ES256 or EdDSA)")
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		exit(err)
+	}
+
+	if *dir == "" {
+		exit(fmt.Errorf("-dir or JWT_KEYS_DIR is required"))
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		if *kid == "" {
+			*kid = time.Now().UTC().Format("20060102150405")
+		}
+		exit(generate(*dir, *kid, *alg))
+	case "activate":
+		exit(activate(*dir, *kid))
+	case "retire":
+		exit(withKeyStore(*dir, func(keys jwt.KeyStore) error { return keys.Retire(*kid) }))
+	case "list":
+		exit(list(*dir))
+	default:
+		usage()
+	}
+}
+
+func generate(dir string, kid string, alg string) error {
+	var key interface{}
+	var err error
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, kid+".pem")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return err
+	}
+
+	fmt.Printf("generated %s key %s at %s\n", alg, kid, path)
+
+	// the first key in a directory becomes the signing key
+	manifest, err := jwt.ReadKeyManifest(dir)
+	if err != nil {
+		return err
+	}
+	if manifest.Active == "" && os.Getenv("JWT_SIGNING_KEY_ID") == "" {
+		manifest.Active = kid
+		return jwt.WriteKeyManifest(dir, manifest)
+	}
+
+	return nil
+}
+
+// activate writes the manifest directly so that a directory whose signing key cannot be
+// determined yet can still be fixed, and restores it if the result does not load.
+func activate(dir string, kid string) error {
+	manifest, err := jwt.ReadKeyManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	previous := *manifest
+	manifest.Active = kid
+	if err := jwt.WriteKeyManifest(dir, manifest); err != nil {
+		return err
+	}
+
+	if _, err := jwt.NewKeyStore(keysConfig(dir)); err != nil {
+		if err := jwt.WriteKeyManifest(dir, &previous); err != nil {
+			return err
+		}
+		return err
+	}
+
+	fmt.Printf("activated key %s\n", kid)
+	return nil
+}
+
+func withKeyStore(dir string, op func(keys jwt.KeyStore) error) error {
+	keys, err := jwt.NewKeyStore(keysConfig(dir))
+	if err != nil {
+		return err
+	}
+
+	return op(keys)
+}
+
+func list(dir string) error {
+	keys, err := jwt.NewKeyStore(keysConfig(dir))
+	if err != nil {
+		return err
+	}
+
+	manifest, err := jwt.ReadKeyManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	active := keys.SigningKey()
+	for _, key := range keys.VerificationKeys() {
+		marker := ""
+		if key.Id == active.Id {
+			marker = " (active)"
+		}
+		fmt.Printf("%s\t%s%s\n", key.Id, key.Method.Alg(), marker)
+	}
+	for _, kid := range manifest.Retired {
+		fmt.Printf("%s\tretired\n", kid)
+	}
+
+	return nil
+}
+
+func keysConfig(dir string) config.JwtConfig {
+	return config.JwtConfig{KeysDir: dir, SigningKeyId: os.Getenv("JWT_SIGNING_KEY_ID")}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: jwtkey <generate|activate|retire|list> -dir <keys dir> [-kid <kid>] [-alg RS256|ES256]")
+	os.Exit(2)
+}
+
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -12,15 +14,18 @@ import (
 
 	"github.com/isd-sgcu/rpkm67-auth/config"
 	"github.com/isd-sgcu/rpkm67-auth/database"
+	"github.com/isd-sgcu/rpkm67-auth/internal/audit"
 	"github.com/isd-sgcu/rpkm67-auth/internal/auth"
 	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
 	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
 	"github.com/isd-sgcu/rpkm67-auth/internal/oauth"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
 	"github.com/isd-sgcu/rpkm67-auth/internal/token"
 	"github.com/isd-sgcu/rpkm67-auth/internal/user"
 	"github.com/isd-sgcu/rpkm67-auth/logger"
 	authProto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/auth/v1"
 	userProto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/user/v1"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -28,6 +33,10 @@ import (
 	"google.golang.org/grpc/reflection"
 )
 
+// cacheHealthService is the name under which the health service reports whether the cache is
+// reachable.
+const cacheHealthService = "cache"
+
 func main() {
 	conf, err := config.LoadConfig()
 	if err != nil {
@@ -41,33 +50,121 @@ func main() {
 		panic(fmt.Sprintf("Failed to connect to database: %v", err))
 	}
 
-	redis, err := database.InitRedis(&conf.Redis)
+	cacheOpts := cache.Options{
+		KeyPrefix: conf.Cache.KeyPrefix,
+		Binary:    conf.Cache.IsBinaryCodec(),
+		Timeout:   time.Duration(conf.Cache.TimeoutMs) * time.Millisecond,
+	}
+
+	var cacheRepo cache.Repository
+	if conf.Cache.IsMemoryStore() {
+		logger.Warn("Using the in-memory cache, sessions are lost on restart and not shared between replicas")
+		cacheRepo = cache.NewMemoryRepository(cacheOpts)
+	} else {
+		redis, err := database.InitRedis(&conf.Redis)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to connect to redis: %v", err))
+		}
+		cacheRepo = cache.NewRepository(redis, cacheOpts)
+	}
+
+	// the cache is reported as its own service, as tokens can still be validated without it
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(cacheHealthService, grpc_health_v1.HealthCheckResponse_SERVING)
+	cacheRepo = cache.NewCircuitBreaker(cacheRepo, cache.BreakerOptions{
+		Threshold: conf.Cache.BreakerThreshold,
+		Cooldown:  time.Duration(conf.Cache.BreakerCooldown) * time.Second,
+		OnStateChange: func(open bool) {
+			if open {
+				healthServer.SetServingStatus(cacheHealthService, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+			} else {
+				healthServer.SetServingStatus(cacheHealthService, grpc_health_v1.HealthCheckResponse_SERVING)
+			}
+		},
+	}, logger.Named("cacheBreaker"))
+
+	keyStore, err := jwt.NewKeyStore(conf.Jwt)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to connect to redis: %v", err))
+		panic(fmt.Sprintf("Failed to load jwt keys: %v", err))
+	}
+	if conf.Jwt.KeysDir != "" && conf.Jwt.KeysReloadInterval > 0 {
+		go reloadKeys(keyStore, time.Duration(conf.Jwt.KeysReloadInterval)*time.Second, logger.Named("keyStore"))
 	}
 
-	cacheRepo := cache.NewRepository(redis)
+	tokenCodec, err := jwt.NewCodec(conf.Jwt.TokenFormat, keyStore, jwt.NewJwtStrategy(keyStore), jwt.NewJwtUtils())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create token codec: %v", err))
+	}
 
+	jwtSvc := jwt.NewService(conf.Jwt, tokenCodec, logger.Named("jwtSvc"))
+	revocations := token.NewRevocationList(cacheRepo, conf.Jwt.RevocationRetention(), logger.Named("revocations"))
+	// the validation cache relies on the revocation list to hear about sign outs on other
+	// replicas, as do tokens accepted on their signature while the cache is unavailable
+	if conf.Jwt.IsStatelessValidation() || conf.Jwt.ValidationCacheSize > 0 || conf.Jwt.IsSignatureOnlyWhenDegraded() {
+		if err := revocations.Sync(context.Background()); err != nil {
+			panic(fmt.Sprintf("Failed to sync revocation list: %v", err))
+		}
+		if conf.Jwt.RevocationSyncInterval > 0 {
+			go syncRevocations(revocations, time.Duration(conf.Jwt.RevocationSyncInterval)*time.Second, logger.Named("revocations"))
+		}
+	}
+
+	validationCache := token.NewValidationCache(conf.Jwt.ValidationCacheSize, conf.Jwt.ValidationCacheTTL)
+	permissionRepo := permission.NewRepository(db)
+	permissionSvc := permission.NewService(&conf.Auth, permissionRepo, logger.Named("permissionSvc"))
+
+	auditRepo := audit.NewRepository(db)
+	auditSvc := audit.NewService(auditRepo, logger.Named("audit"))
+
+	tokenSvc := token.NewService(jwtSvc, permissionSvc, cacheRepo, revocations, validationCache, token.NewTokenUtils(), logger.Named("tokenSvc"))
 	userRepo := user.NewRepository(db)
-	userSvc := user.NewService(userRepo, logger.Named("userSvc"))
+	userSvc := user.NewService(userRepo, tokenSvc, logger.Named("userSvc"))
 
-	jwtSvc := jwt.NewService(conf.Jwt, jwt.NewJwtStrategy(conf.Jwt.Secret), jwt.NewJwtUtils(), logger.Named("jwtSvc"))
-	tokenSvc := token.NewService(jwtSvc, cacheRepo, token.NewTokenUtils(), logger.Named("tokenSvc"))
 	oauthConfig := config.LoadOauthConfig(conf.Oauth)
 	oauthClient := oauth.NewGoogleOauthClient(oauthConfig, logger.Named("oauthClient"))
-	authSvc := auth.NewService(&conf.Auth, oauthConfig, oauthClient, userSvc, tokenSvc, auth.NewAuthUtils(), logger.Named("authSvc"))
+	oauthStates := oauth.NewStateStore(cacheRepo, conf.Oauth.StateTTL)
+	authSvc := auth.NewService(&conf.Auth, oauthConfig, oauthClient, oauthStates, userSvc, tokenSvc, permissionSvc, auditSvc, keyStore, auth.NewAuthUtils(), auth.NewBcryptUtils(), logger.Named("authSvc"))
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", conf.App.Port))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to listen: %v", err))
 	}
 
-	grpcServer := grpc.NewServer()
-	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	serverOptions := []grpc.ServerOption{}
+	if conf.Auth.RequireServiceToken {
+		if len(conf.Auth.ServiceClients) == 0 {
+			logger.Warn("AUTH_REQUIRE_SERVICE_TOKEN is on but AUTH_SERVICE_CLIENTS is empty, so no service can call the user service")
+		}
+		protectedServices := []string{userProto.UserService_ServiceDesc.ServiceName}
+		serverOptions = append(serverOptions, grpc.UnaryInterceptor(auth.NewServiceAuthInterceptor(tokenSvc, protectedServices, logger.Named("interceptor"))))
+	}
+
+	grpcServer := grpc.NewServer(serverOptions...)
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
 	userProto.RegisterUserServiceServer(grpcServer, userSvc)
 	authProto.RegisterAuthServiceServer(grpcServer, authSvc)
+	grpcServer.RegisterService(&auth.ExtServiceDesc, authSvc)
 
 	reflection.Register(grpcServer)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle(jwt.JwksPath, jwt.NewJwksHandler(keyStore, conf.Jwt.JwksMaxAge, logger.Named("jwksHandler")))
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf(":%v", conf.App.HttpPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if conf.App.HttpPort != "" {
+		go func() {
+			logger.Sugar().Infof("RPKM67 Auth HTTP starting at port %v", conf.App.HttpPort)
+
+			if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("Failed to start RPKM67 Auth HTTP server", zap.Error(err))
+			}
+		}()
+	}
+
 	go func() {
 		logger.Sugar().Infof("RPKM67 Auth starting at port %v", conf.App.Port)
 
@@ -81,6 +178,9 @@ func main() {
 			grpcServer.GracefulStop()
 			return nil
 		},
+		"http": func(ctx context.Context) error {
+			return httpServer.Shutdown(ctx)
+		},
 		"database": func(ctx context.Context) error {
 			sqlDB, err := db.DB()
 			if err != nil {
@@ -101,6 +201,31 @@ func main() {
 	logger.Info("RPKM67 Auth service has been shutdown gracefully")
 }
 
+// reloadKeys picks up keys and rotations made by other replicas or the jwtkey CLI.
+func reloadKeys(keyStore jwt.KeyStore, interval time.Duration, log *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := keyStore.Reload(); err != nil {
+			log.Error("Failed to reload jwt keys", zap.Error(err))
+		}
+	}
+}
+
+// syncRevocations keeps the in-memory revocation list used by stateless validation up to
+// date. A failed sync keeps the last synced list.
+func syncRevocations(revocations token.RevocationList, interval time.Duration, log *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := revocations.Sync(context.Background()); err != nil {
+			log.Warn("Failed to sync revocation list", zap.Error(err))
+		}
+	}
+}
+
 type operation func(ctx context.Context) error
 
 func gracefulShutdown(ctx context.Context, timeout time.Duration, log *zap.Logger, ops map[string]operation) <-chan struct{} {
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
@@ -10,8 +12,9 @@ import (
 )
 
 type AppConfig struct {
-	Port string
-	Env  string
+	Port     string
+	HttpPort string
+	Env      string
 }
 
 type DbConfig struct {
@@ -21,30 +24,114 @@ type DbConfig struct {
 type RedisConfig struct {
 	Host     string
 	Port     int
+	Username string
 	Password string
+	// Mode is "standalone", "sentinel" or "cluster". Addrs lists the sentinels or the cluster
+	// nodes, and defaults to Host:Port.
+	Mode             string
+	Addrs            []string
+	MasterName       string
+	SentinelPassword string
+	DB               int
+	// PoolSize is the number of connections per node, or the go-redis default when zero.
+	PoolSize     int
+	MinIdleConns int
+	TLS          bool
+	// TLSCAFile is a PEM bundle of the CAs to trust instead of the system roots.
+	TLSCAFile     string
+	TLSServerName string
+	// ConnectRetries is how many more times the startup ping is tried, ConnectRetryInterval
+	// seconds apart, before the service gives up.
+	ConnectRetries       int
+	ConnectRetryInterval int
+}
+
+type CacheConfig struct {
+	// Store is "redis", or "memory" to keep sessions in the process for development and tests.
+	// The memory store is not shared between replicas and is lost on restart.
+	Store string
+	// KeyPrefix namespaces every key, e.g. "rpkm67:prod:", so environments or events sharing
+	// a redis do not collide. Changing it signs everyone out.
+	KeyPrefix string
+	// Codec is "json", or "binary" to store sessions and refresh tokens in the protobuf wire
+	// format. Values in either format are read whichever is configured.
+	Codec string
+	// TimeoutMs bounds every redis call in milliseconds.
+	TimeoutMs int
+	// BreakerThreshold is how many redis calls in a row have to fail before further calls fail
+	// fast for BreakerCooldown seconds. Zero disables the circuit breaker.
+	BreakerThreshold int
+	BreakerCooldown  int
 }
 
 type JwtConfig struct {
-	Secret     string
-	AccessTTL  int
-	RefreshTTL int
-	Issuer     string
+	Secret       string
+	AccessTTL    int
+	RefreshTTL   int
+	Issuer       string
+	SigningKeyId string
+	// TokenFormat is "jwt" or "paseto" for PASETO v4.public, which needs an Ed25519 signing
+	// key. Tokens in either format are accepted whichever is configured.
+	TokenFormat        string
+	KeysDir            string
+	KeysReloadInterval int
+	JwksMaxAge         int
+	// ValidationMode is "session" to check every access token against its session in the
+	// cache, or "stateless" to accept it on signature, expiry and the revocation list alone.
+	ValidationMode         string
+	RevocationSyncInterval int
+	ValidationCacheSize    int
+	ValidationCacheTTL     int
+	// ClientAudiences lists the audiences each client may request tokens for. Tokens are
+	// issued without an audience when it is empty.
+	ClientAudiences map[string][]string
+	ServiceTokenTTL int
+	// ImpersonationTTL is the lifetime of tokens issued to staff acting as another user.
+	ImpersonationTTL int
+	QrTokenTTL       int
+	// SessionIdleTimeout ends a session that has not been refreshed for this many seconds and
+	// SessionMaxAge ends it this many seconds after login, however often it is refreshed.
+	// The idle timeout is off by default, leaving it to the refresh TTL, and the maximum age
+	// defaults to 30 days; zero disables either limit.
+	SessionIdleTimeout int
+	SessionMaxAge      int
+	// RefreshTokenHashKey keys the HMAC under which refresh tokens are stored and the new pair
+	// kept for duplicate refreshes is sealed. Changing it invalidates every refresh token. It
+	// defaults to Secret when tokens are signed with it, and is required otherwise.
+	RefreshTokenHashKey string
+	// RefreshGracePeriod is how many seconds after a refresh token is used a duplicate refresh
+	// with it, e.g. from a second tab, gets the same new pair instead of being treated as reuse.
+	RefreshGracePeriod int
+	// DegradedPolicy is what ValidateToken does while the cache is unreachable: "reject" the
+	// token, or accept it on "signature", expiry and the last synced revocation list. Logins
+	// and refreshes need the cache either way and are refused.
+	DegradedPolicy string
 }
 
 type AuthConfig struct {
 	CheckChulaEmail bool
+	AdminUserIds    []string
+	// ServiceClients maps the client id of each trusted rpkm67 service to the bcrypt hash of
+	// its secret.
+	ServiceClients map[string]string
+	// RequireServiceToken makes calls to the user service present a service token. It is on
+	// unless AUTH_REQUIRE_SERVICE_TOKEN is "false".
+	RequireServiceToken bool
 }
 
 type OauthConfig struct {
 	ClientId     string
 	ClientSecret string
 	RedirectUri  string
+	// StateTTL is how many seconds a user has to come back from Google after starting a login.
+	StateTTL int
 }
 
 type Config struct {
 	App   AppConfig
 	Db    DbConfig
 	Redis RedisConfig
+	Cache CacheConfig
 	Jwt   JwtConfig
 	Auth  AuthConfig
 	Oauth OauthConfig
@@ -59,23 +146,87 @@ func LoadConfig() (*Config, error) {
 	}
 
 	appConfig := AppConfig{
-		Port: os.Getenv("APP_PORT"),
-		Env:  os.Getenv("APP_ENV"),
+		Port:     os.Getenv("APP_PORT"),
+		HttpPort: os.Getenv("APP_HTTP_PORT"),
+		Env:      os.Getenv("APP_ENV"),
 	}
 
 	dbConfig := DbConfig{
 		Url: os.Getenv("DB_URL"),
 	}
 
-	redisPort, err := strconv.ParseInt(os.Getenv("REDIS_PORT"), 10, 64)
+	cacheTimeout, err := getEnvInt("CACHE_TIMEOUT_MS", 5000)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheBreakerThreshold, err := getEnvInt("CACHE_BREAKER_THRESHOLD", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheBreakerCooldown, err := getEnvInt("CACHE_BREAKER_COOLDOWN", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheConfig := CacheConfig{
+		Store:            os.Getenv("CACHE_STORE"),
+		KeyPrefix:        os.Getenv("CACHE_KEY_PREFIX"),
+		Codec:            os.Getenv("CACHE_CODEC"),
+		TimeoutMs:        cacheTimeout,
+		BreakerThreshold: cacheBreakerThreshold,
+		BreakerCooldown:  cacheBreakerCooldown,
+	}
+
+	// redis is not needed with the memory store
+	redisPort, err := getEnvInt("REDIS_PORT", 6379)
+	if err != nil {
+		return nil, err
+	}
+
+	redisDB, err := getEnvInt("REDIS_DB", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	redisPoolSize, err := getEnvInt("REDIS_POOL_SIZE", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	redisMinIdleConns, err := getEnvInt("REDIS_MIN_IDLE_CONNS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	redisConnectRetries, err := getEnvInt("REDIS_CONNECT_RETRIES", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	redisConnectRetryInterval, err := getEnvInt("REDIS_CONNECT_RETRY_INTERVAL", 2)
 	if err != nil {
 		return nil, err
 	}
 
 	redisConfig := RedisConfig{
-		Host:     os.Getenv("REDIS_HOST"),
-		Port:     int(redisPort),
-		Password: os.Getenv("REDIS_PASSWORD"),
+		Host:                 os.Getenv("REDIS_HOST"),
+		Port:                 redisPort,
+		Username:             os.Getenv("REDIS_USERNAME"),
+		Password:             os.Getenv("REDIS_PASSWORD"),
+		Mode:                 os.Getenv("REDIS_MODE"),
+		Addrs:                splitEnvList(os.Getenv("REDIS_ADDRS")),
+		MasterName:           os.Getenv("REDIS_MASTER_NAME"),
+		SentinelPassword:     os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		DB:                   redisDB,
+		PoolSize:             redisPoolSize,
+		MinIdleConns:         redisMinIdleConns,
+		TLS:                  os.Getenv("REDIS_TLS") == "true",
+		TLSCAFile:            os.Getenv("REDIS_TLS_CA_FILE"),
+		TLSServerName:        os.Getenv("REDIS_TLS_SERVER_NAME"),
+		ConnectRetries:       redisConnectRetries,
+		ConnectRetryInterval: redisConnectRetryInterval,
 	}
 
 	accessTTL, err := strconv.ParseInt(os.Getenv("JWT_ACCESS_TTL"), 10, 64)
@@ -87,37 +238,218 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	keysReloadInterval, err := getEnvInt("JWT_KEYS_RELOAD_INTERVAL", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	jwksMaxAge, err := getEnvInt("JWT_JWKS_MAX_AGE", 300)
+	if err != nil {
+		return nil, err
+	}
+
+	revocationSyncInterval, err := getEnvInt("JWT_REVOCATION_SYNC_INTERVAL", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	validationCacheSize, err := getEnvInt("JWT_VALIDATION_CACHE_SIZE", 10000)
+	if err != nil {
+		return nil, err
+	}
+
+	validationCacheTTL, err := getEnvInt("JWT_VALIDATION_CACHE_TTL", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceTokenTTL, err := getEnvInt("JWT_SERVICE_TOKEN_TTL", 300)
+	if err != nil {
+		return nil, err
+	}
+
+	impersonationTTL, err := getEnvInt("JWT_IMPERSONATION_TTL", 900)
+	if err != nil {
+		return nil, err
+	}
+
+	qrTokenTTL, err := getEnvInt("JWT_QR_TOKEN_TTL", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionIdleTimeout, err := getEnvInt("JWT_SESSION_IDLE_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionMaxAge, err := getEnvInt("JWT_SESSION_MAX_AGE", 2592000)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshGracePeriod, err := getEnvInt("JWT_REFRESH_GRACE_PERIOD", 10)
+	if err != nil {
+		return nil, err
+	}
+
 	jwtConfig := JwtConfig{
-		Secret:     os.Getenv("JWT_SECRET"),
-		AccessTTL:  int(accessTTL),
-		RefreshTTL: int(refreshTTL),
-		Issuer:     os.Getenv("JWT_ISSUER"),
+		Secret:                 os.Getenv("JWT_SECRET"),
+		AccessTTL:              int(accessTTL),
+		RefreshTTL:             int(refreshTTL),
+		Issuer:                 os.Getenv("JWT_ISSUER"),
+		SigningKeyId:           os.Getenv("JWT_SIGNING_KEY_ID"),
+		TokenFormat:            os.Getenv("JWT_TOKEN_FORMAT"),
+		KeysDir:                os.Getenv("JWT_KEYS_DIR"),
+		KeysReloadInterval:     keysReloadInterval,
+		JwksMaxAge:             jwksMaxAge,
+		ValidationMode:         os.Getenv("JWT_VALIDATION_MODE"),
+		RevocationSyncInterval: revocationSyncInterval,
+		ValidationCacheSize:    validationCacheSize,
+		ValidationCacheTTL:     validationCacheTTL,
+		ClientAudiences:        parseClientAudiences(os.Getenv("JWT_CLIENT_AUDIENCES")),
+		ServiceTokenTTL:        serviceTokenTTL,
+		ImpersonationTTL:       impersonationTTL,
+		QrTokenTTL:             qrTokenTTL,
+		SessionIdleTimeout:     sessionIdleTimeout,
+		SessionMaxAge:          sessionMaxAge,
+		RefreshTokenHashKey:    os.Getenv("JWT_REFRESH_TOKEN_HASH_KEY"),
+		RefreshGracePeriod:     refreshGracePeriod,
+		DegradedPolicy:         os.Getenv("JWT_DEGRADED_POLICY"),
+	}
+	if jwtConfig.RefreshTokenKey() == "" {
+		return nil, errors.New("JWT_REFRESH_TOKEN_HASH_KEY is required when tokens are not signed with JWT_SECRET")
 	}
 
 	authConfig := AuthConfig{
-		CheckChulaEmail: os.Getenv("AUTH_CHECK_CHULA_EMAIL") == "true",
+		CheckChulaEmail:     os.Getenv("AUTH_CHECK_CHULA_EMAIL") == "true",
+		AdminUserIds:        splitEnvList(os.Getenv("AUTH_ADMIN_USER_IDS")),
+		ServiceClients:      parseServiceClients(os.Getenv("AUTH_SERVICE_CLIENTS")),
+		RequireServiceToken: os.Getenv("AUTH_REQUIRE_SERVICE_TOKEN") != "false",
+	}
+
+	oauthStateTTL, err := getEnvInt("OAUTH_STATE_TTL", 600)
+	if err != nil {
+		return nil, err
 	}
 
 	oauthConfig := OauthConfig{
 		ClientId:     os.Getenv("OAUTH_CLIENT_ID"),
 		ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
 		RedirectUri:  os.Getenv("OAUTH_REDIRECT_URI"),
+		StateTTL:     oauthStateTTL,
 	}
 
 	return &Config{
 		App:   appConfig,
 		Db:    dbConfig,
 		Redis: redisConfig,
+		Cache: cacheConfig,
 		Jwt:   jwtConfig,
 		Auth:  authConfig,
 		Oauth: oauthConfig,
 	}, nil
 }
 
+// getEnvInt parses an optional integer variable, falling back to the default when it is unset.
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(parsed), nil
+}
+
+func splitEnvList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// parseClientAudiences reads "client=aud1,aud2;client2=aud3". An entry without a client or
+// audiences is skipped, so its client is refused rather than issued tokens for any audience.
+func parseClientAudiences(value string) map[string][]string {
+	clientAudiences := map[string][]string{}
+
+	for _, entry := range strings.Split(value, ";") {
+		client, audiences, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		client = strings.TrimSpace(client)
+		if !ok || client == "" || len(splitEnvList(audiences)) == 0 {
+			continue
+		}
+
+		clientAudiences[client] = append(clientAudiences[client], splitEnvList(audiences)...)
+	}
+
+	return clientAudiences
+}
+
+// parseServiceClients reads "client=bcrypt hash;client2=bcrypt hash".
+func parseServiceClients(value string) map[string]string {
+	serviceClients := map[string]string{}
+
+	for _, entry := range strings.Split(value, ";") {
+		client, hash, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && client != "" && hash != "" {
+			serviceClients[client] = hash
+		}
+	}
+
+	return serviceClients
+}
+
 func (ac *AppConfig) IsDevelopment() bool {
 	return ac.Env == "development"
 }
 
+func (cc *CacheConfig) IsMemoryStore() bool {
+	return cc.Store == "memory"
+}
+
+func (cc *CacheConfig) IsBinaryCodec() bool {
+	return cc.Codec == "binary"
+}
+
+func (jc *JwtConfig) IsStatelessValidation() bool {
+	return jc.ValidationMode == "stateless"
+}
+
+// RefreshTokenKey is the key refresh tokens are hashed with: RefreshTokenHashKey, or the HS256
+// Secret when no KeysDir is set. It is empty when neither is configured.
+func (jc *JwtConfig) RefreshTokenKey() string {
+	if jc.RefreshTokenHashKey != "" {
+		return jc.RefreshTokenHashKey
+	}
+	if jc.KeysDir == "" {
+		return jc.Secret
+	}
+
+	return ""
+}
+
+// RevocationRetention is how many seconds the cut-off of a revoked user or role is kept: as
+// long as any token issued before it, access or refresh, can still be presented.
+func (jc *JwtConfig) RevocationRetention() int {
+	return max(jc.AccessTTL, jc.ImpersonationTTL, jc.RefreshTTL, jc.SessionMaxAge)
+}
+
+// IsSignatureOnlyWhenDegraded reports whether access tokens are accepted without their session
+// while the cache is unreachable.
+func (jc *JwtConfig) IsSignatureOnlyWhenDegraded() bool {
+	return jc.DegradedPolicy == "signature"
+}
+
 func LoadOauthConfig(oauth OauthConfig) *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     oauth.ClientId,
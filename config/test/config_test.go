@@ -0,0 +1,138 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshTokenKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.JwtConfig
+		expected string
+	}{
+		{
+			name:     "hash key",
+			conf:     config.JwtConfig{Secret: "secret", RefreshTokenHashKey: "hash-key"},
+			expected: "hash-key",
+		},
+		{
+			name:     "falls back to the HS256 secret",
+			conf:     config.JwtConfig{Secret: "secret"},
+			expected: "secret",
+		},
+		{
+			name:     "no fallback with signing keys",
+			conf:     config.JwtConfig{Secret: "secret", KeysDir: "keys"},
+			expected: "",
+		},
+		{
+			name:     "hash key with signing keys",
+			conf:     config.JwtConfig{KeysDir: "keys", RefreshTokenHashKey: "hash-key"},
+			expected: "hash-key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.conf.RefreshTokenKey())
+		})
+	}
+}
+
+func TestLoadConfigRequiresRefreshTokenKey(t *testing.T) {
+	t.Setenv("APP_ENV", "test")
+	t.Setenv("JWT_ACCESS_TTL", "3600")
+	t.Setenv("JWT_REFRESH_TTL", "259200")
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_KEYS_DIR", t.TempDir())
+	t.Setenv("JWT_REFRESH_TOKEN_HASH_KEY", "")
+
+	_, err := config.LoadConfig()
+	assert.Error(t, err)
+
+	t.Setenv("JWT_REFRESH_TOKEN_HASH_KEY", "hash-key")
+	conf, err := config.LoadConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hash-key", conf.Jwt.RefreshTokenKey())
+	}
+}
+
+func TestRevocationRetention(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     config.JwtConfig
+		expected int
+	}{
+		{
+			name:     "refresh tokens outlive access tokens",
+			conf:     config.JwtConfig{AccessTTL: 3600, RefreshTTL: 259200},
+			expected: 259200,
+		},
+		{
+			name:     "sessions outlive refresh tokens",
+			conf:     config.JwtConfig{AccessTTL: 3600, RefreshTTL: 259200, SessionMaxAge: 2592000},
+			expected: 2592000,
+		},
+		{
+			name:     "impersonation tokens outlive the rest",
+			conf:     config.JwtConfig{AccessTTL: 60, RefreshTTL: 60, ImpersonationTTL: 3600},
+			expected: 3600,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.conf.RevocationRetention())
+		})
+	}
+}
+
+func TestLoadConfigClientAudiences(t *testing.T) {
+	t.Setenv("APP_ENV", "test")
+	t.Setenv("JWT_ACCESS_TTL", "3600")
+	t.Setenv("JWT_REFRESH_TTL", "259200")
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("JWT_CLIENT_AUDIENCES", " gateway = web, ,app ;;no-audiences=;missing-equals;=orphan;gateway=admin;checkin=checkin")
+
+	conf, err := config.LoadConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]string{
+			"gateway": {"web", "app", "admin"},
+			"checkin": {"checkin"},
+		}, conf.Jwt.ClientAudiences)
+	}
+}
+
+func TestLoadConfigRequiresServiceTokenByDefault(t *testing.T) {
+	t.Setenv("APP_ENV", "test")
+	t.Setenv("JWT_ACCESS_TTL", "3600")
+	t.Setenv("JWT_REFRESH_TTL", "259200")
+	t.Setenv("JWT_SECRET", "secret")
+
+	for value, expected := range map[string]bool{"": true, "true": true, "false": false} {
+		t.Setenv("AUTH_REQUIRE_SERVICE_TOKEN", value)
+
+		conf, err := config.LoadConfig()
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, conf.Auth.RequireServiceToken, "AUTH_REQUIRE_SERVICE_TOKEN=%q", value)
+		}
+	}
+}
+
+func TestLoadConfigSessionLimits(t *testing.T) {
+	t.Setenv("APP_ENV", "test")
+	t.Setenv("JWT_ACCESS_TTL", "3600")
+	t.Setenv("JWT_REFRESH_TTL", "259200")
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("JWT_SESSION_IDLE_TIMEOUT", "")
+	t.Setenv("JWT_SESSION_MAX_AGE", "")
+
+	conf, err := config.LoadConfig()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, conf.Jwt.SessionIdleTimeout)
+		assert.Equal(t, 2592000, conf.Jwt.SessionMaxAge)
+	}
+}
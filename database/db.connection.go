@@ -2,6 +2,8 @@ package database
 
 import (
 	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/audit"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
 	"github.com/isd-sgcu/rpkm67-model/model"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -20,7 +22,7 @@ func InitDatabase(conf *config.DbConfig, isDebug bool) (db *gorm.DB, err error)
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&model.Group{}, &model.User{}, &model.Selection{}, &model.Stamp{}, &model.CheckIn{})
+	err = db.AutoMigrate(&model.Group{}, &model.User{}, &model.Selection{}, &model.Stamp{}, &model.CheckIn{}, &permission.RolePermission{}, &permission.UserPermission{}, &audit.AuditLog{})
 	if err != nil {
 		return nil, err
 	}
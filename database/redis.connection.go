@@ -1,24 +1,119 @@
 package database
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/isd-sgcu/rpkm67-auth/config"
 	"github.com/redis/go-redis/v9"
 )
 
-func InitRedis(conf *config.RedisConfig) (*redis.Client, error) {
-	addr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// InitRedis connects to a standalone redis, a sentinel-managed master or a cluster, and
+// returns once the server answers a ping. The ping is retried so the service can start
+// alongside redis.
+func InitRedis(conf *config.RedisConfig) (redis.UniversalClient, error) {
+	tlsConfig, err := redisTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := conf.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%d", conf.Host, conf.Port)}
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         conf.Username,
+		Password:         conf.Password,
+		MasterName:       conf.MasterName,
+		SentinelPassword: conf.SentinelPassword,
+		DB:               conf.DB,
+		PoolSize:         conf.PoolSize,
+		MinIdleConns:     conf.MinIdleConns,
+		TLSConfig:        tlsConfig,
+		// lets the cache timeout and the caller's deadline bound reads and writes, rather than
+		// the client's own read and write timeouts
+		ContextTimeoutEnabled: true,
+	}
+
+	var client redis.UniversalClient
+	switch conf.Mode {
+	case "", RedisStandalone:
+		client = redis.NewClient(opts.Simple())
+	case RedisSentinel:
+		if conf.MasterName == "" {
+			return nil, errors.New("REDIS_MASTER_NAME is required in sentinel mode")
+		}
+		client = redis.NewFailoverClient(opts.Failover())
+	case RedisCluster:
+		if conf.DB != 0 {
+			return nil, errors.New("redis cluster only has database 0")
+		}
+		client = redis.NewClusterClient(opts.Cluster())
+	default:
+		return nil, fmt.Errorf("unsupported redis mode %s", conf.Mode)
+	}
+
+	if err := pingRedis(client, conf.ConnectRetries, time.Duration(conf.ConnectRetryInterval)*time.Second); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func redisTLSConfig(conf *config.RedisConfig) (*tls.Config, error) {
+	if !conf.TLS && conf.TLSCAFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: conf.TLSServerName,
+	}
+
+	if conf.TLSCAFile != "" {
+		pem, err := os.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.TLSCAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+
+	return tlsConfig, nil
+}
 
-	cache := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: conf.Password,
-	})
+func pingRedis(client redis.UniversalClient, retries int, interval time.Duration) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(interval)
+		}
 
-	if cache == nil {
-		return nil, errors.New("Failed to connect to redis server")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = client.Ping(ctx).Err()
+		cancel()
+		if err == nil {
+			return nil
+		}
 	}
 
-	return cache, nil
+	return fmt.Errorf("redis did not answer a ping in %d attempts: %w", retries+1, err)
 }
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableAddr refuses connections straight away, so a failed ping does not wait on a timeout.
+const unreachableAddr = "127.0.0.1:1"
+
+func TestInitRedisInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	notPem := filepath.Join(dir, "ca.txt")
+	require.NoError(t, os.WriteFile(notPem, []byte("not a certificate"), 0o600))
+
+	tests := []struct {
+		name     string
+		conf     config.RedisConfig
+		contains string
+	}{
+		{
+			name:     "unsupported mode",
+			conf:     config.RedisConfig{Mode: "replica"},
+			contains: "unsupported redis mode",
+		},
+		{
+			name:     "sentinel without master name",
+			conf:     config.RedisConfig{Mode: database.RedisSentinel},
+			contains: "REDIS_MASTER_NAME",
+		},
+		{
+			name:     "cluster with a database index",
+			conf:     config.RedisConfig{Mode: database.RedisCluster, DB: 1},
+			contains: "database 0",
+		},
+		{
+			name:     "missing CA file",
+			conf:     config.RedisConfig{TLS: true, TLSCAFile: filepath.Join(dir, "missing.pem")},
+			contains: "missing.pem",
+		},
+		{
+			name:     "CA file without certificates",
+			conf:     config.RedisConfig{TLS: true, TLSCAFile: notPem},
+			contains: "no certificates found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Addrs = []string{unreachableAddr}
+
+			client, err := database.InitRedis(&tt.conf)
+			assert.Nil(t, client)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.contains)
+			}
+		})
+	}
+}
+
+func TestInitRedisPingRetries(t *testing.T) {
+	conf := &config.RedisConfig{
+		Addrs:                []string{unreachableAddr},
+		ConnectRetries:       1,
+		ConnectRetryInterval: 1,
+	}
+
+	start := time.Now()
+	client, err := database.InitRedis(conf)
+
+	assert.Nil(t, client)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "in 2 attempts")
+	}
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestInitRedisTLSWithCAFile(t *testing.T) {
+	conf := &config.RedisConfig{
+		Addrs:     []string{unreachableAddr},
+		TLS:       true,
+		TLSCAFile: writeCA(t),
+	}
+
+	// the CA is accepted, so it is the ping that fails
+	_, err := database.InitRedis(conf)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "in 1 attempts")
+	}
+}
+
+// TestInitRedis connects to the redis at REDIS_TEST_ADDR, e.g.
+// REDIS_TEST_ADDR=localhost:6379 REDIS_TEST_PASSWORD=5678 go test ./database/...
+func TestInitRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+
+	client, err := database.InitRedis(&config.RedisConfig{
+		Addrs:    []string{addr},
+		Password: os.Getenv("REDIS_TEST_PASSWORD"),
+		PoolSize: 2,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	assert.NoError(t, client.Ping(context.Background()).Err())
+}
+
+// writeCA writes a self-signed CA certificate and returns its path.
+func writeCA(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+
+	return path
+}
@@ -0,0 +1,48 @@
+package apperror
+
+import "google.golang.org/grpc/codes"
+
+var (
+	Internal         = New(codes.Internal, "INTERNAL", "internal error")
+	CacheUnavailable = New(codes.Unavailable, "CACHE_UNAVAILABLE", "cache is unavailable")
+)
+
+// token
+var (
+	InvalidToken         = New(codes.Unauthenticated, "INVALID_TOKEN", "invalid token")
+	TokenExpired         = New(codes.Unauthenticated, "TOKEN_EXPIRED", "token has expired")
+	TokenRevoked         = New(codes.Unauthenticated, "TOKEN_REVOKED", "token has been revoked")
+	RefreshTokenNotFound = New(codes.Unauthenticated, "REFRESH_TOKEN_NOT_FOUND", "refresh token not found")
+	RefreshTokenReused   = New(codes.Unauthenticated, "REFRESH_TOKEN_REUSED", "refresh token has already been used")
+	SessionExpired       = New(codes.Unauthenticated, "SESSION_EXPIRED", "session has expired")
+	NotRefreshable       = New(codes.Unauthenticated, "NOT_REFRESHABLE", "impersonation sessions cannot be refreshed")
+	AudienceNotAllowed   = New(codes.PermissionDenied, "AUDIENCE_NOT_ALLOWED", "client is not allowed to request this audience")
+	QrTokenInvalid       = New(codes.Unauthenticated, "QR_TOKEN_INVALID", "invalid qr token")
+	QrTokenConsumed      = New(codes.FailedPrecondition, "QR_TOKEN_CONSUMED", "qr token has already been redeemed")
+	InvalidServiceToken  = New(codes.Unauthenticated, "INVALID_SERVICE_TOKEN", "invalid service token")
+	InvalidClient        = New(codes.Unauthenticated, "INVALID_CLIENT", "invalid client credentials")
+)
+
+// authorization
+var (
+	MissingPermission      = New(codes.PermissionDenied, "MISSING_PERMISSION", "missing permission")
+	ImpersonationForbidden = New(codes.PermissionDenied, "IMPERSONATION_FORBIDDEN", "impersonation tokens cannot be used for this call")
+	PrivilegedUser         = New(codes.PermissionDenied, "PRIVILEGED_USER", "users who can manage permissions or impersonate cannot be impersonated")
+	InvalidPermission      = New(codes.InvalidArgument, "INVALID_PERMISSION", "invalid permission, expected a scope such as checkin:write")
+)
+
+// oauth
+var (
+	InvalidCode         = New(codes.InvalidArgument, "INVALID_CODE", "invalid code")
+	InvalidState        = New(codes.InvalidArgument, "INVALID_STATE", "login attempt is unknown, expired or already used")
+	MissingOauthBinding = New(codes.InvalidArgument, "MISSING_OAUTH_BINDING", "login attempt is not bound to a browser")
+	OauthUnavailable    = New(codes.Unavailable, "OAUTH_UNAVAILABLE", "unable to get user info from google")
+	NotChulaStudent     = New(codes.PermissionDenied, "NOT_CHULA_STUDENT", "email is not a chula student")
+)
+
+// user
+var (
+	UserNotFound   = New(codes.NotFound, "USER_NOT_FOUND", "user not found")
+	DuplicateEmail = New(codes.AlreadyExists, "DUPLICATE_EMAIL", "duplicate email")
+	InvalidUserId  = New(codes.InvalidArgument, "INVALID_USER_ID", "invalid user id, expected a uuid")
+)
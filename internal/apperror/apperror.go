@@ -0,0 +1,101 @@
+package apperror
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Domain is the errdetails.ErrorInfo domain of every error returned by this service.
+const Domain = "auth.rpkm67.isd.sgcu.in.th"
+
+// AppError is an error with the gRPC code it maps to and a machine-readable reason, which
+// clients receive as errdetails.ErrorInfo. Handlers may return it as is: gRPC picks up the
+// status through GRPCStatus.
+type AppError struct {
+	Code    codes.Code
+	Reason  string
+	Message string
+	// Metadata is sent as the ErrorInfo metadata, e.g. the missing permission.
+	Metadata map[string]string
+	cause    error
+}
+
+func New(code codes.Code, reason string, message string) *AppError {
+	return &AppError{Code: code, Reason: reason, Message: message}
+}
+
+func (e *AppError) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.cause
+}
+
+// Is matches on the reason, so a wrapped error still matches its sentinel.
+func (e *AppError) Is(target error) bool {
+	t, ok := target.(*AppError)
+	return ok && t.Reason == e.Reason
+}
+
+// Wrap returns a copy of the error that records cause. Only Message is sent to clients.
+func (e *AppError) Wrap(cause error) *AppError {
+	return &AppError{Code: e.Code, Reason: e.Reason, Message: e.Message, Metadata: e.Metadata, cause: cause}
+}
+
+// With returns a copy of the error with key set in its metadata.
+func (e *AppError) With(key string, value string) *AppError {
+	metadata := make(map[string]string, len(e.Metadata)+1)
+	for k, v := range e.Metadata {
+		metadata[k] = v
+	}
+	metadata[key] = value
+
+	return &AppError{Code: e.Code, Reason: e.Reason, Message: e.Message, Metadata: metadata, cause: e.cause}
+}
+
+func (e *AppError) GRPCStatus() *status.Status {
+	st := status.New(e.Code, e.Message)
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   e.Reason,
+		Domain:   Domain,
+		Metadata: e.Metadata,
+	})
+	if err != nil {
+		return st
+	}
+
+	return withDetails
+}
+
+// ToStatus converts any error into one that carries a gRPC status. An AppError keeps its own
+// code, even when it wraps a context error such as the timeout of a cache call. Otherwise a
+// cancelled or timed out context of the caller becomes Canceled or DeadlineExceeded, and
+// errors that are not already a status become Internal.
+func ToStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.GRPCStatus().Err()
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return Internal.Wrap(err).GRPCStatus().Err()
+}
@@ -0,0 +1,68 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type AppErrorTest struct {
+	suite.Suite
+}
+
+func TestAppError(t *testing.T) {
+	suite.Run(t, new(AppErrorTest))
+}
+
+func (t *AppErrorTest) TestToStatusErrorInfo() {
+	err := apperror.ToStatus(apperror.MissingPermission.With("permission", "checkin:write"))
+
+	st, ok := status.FromError(err)
+	t.Require().True(ok)
+	t.Equal(codes.PermissionDenied, st.Code())
+	t.Require().Len(st.Details(), 1)
+
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	t.Equal("MISSING_PERMISSION", info.Reason)
+	t.Equal(apperror.Domain, info.Domain)
+	t.Equal("checkin:write", info.Metadata["permission"])
+}
+
+func (t *AppErrorTest) TestWrappedErrorMatchesSentinel() {
+	err := apperror.TokenExpired.Wrap(errors.New("token is expired"))
+
+	t.ErrorIs(err, apperror.TokenExpired)
+	t.NotErrorIs(err, apperror.InvalidToken)
+	t.Equal(codes.Unauthenticated, status.Code(apperror.ToStatus(err)))
+}
+
+func (t *AppErrorTest) TestToStatusUnknownError() {
+	err := apperror.ToStatus(errors.New("boom"))
+
+	t.Equal(codes.Internal, status.Code(err))
+	t.NotContains(status.Convert(err).Message(), "boom")
+}
+
+func (t *AppErrorTest) TestToStatusContextError() {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{err: context.Canceled, code: codes.Canceled},
+		{err: context.DeadlineExceeded, code: codes.DeadlineExceeded},
+		{err: fmt.Errorf("get session: %w", context.Canceled), code: codes.Canceled},
+		// a cache call that timed out of its own is the cache being unavailable
+		{err: apperror.CacheUnavailable.Wrap(context.DeadlineExceeded), code: codes.Unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Equal(tt.code, status.Code(apperror.ToStatus(tt.err)), tt.err.Error())
+	}
+}
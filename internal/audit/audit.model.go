@@ -0,0 +1,23 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type AuditLog struct {
+	ID        uuid.UUID `json:"id" gorm:"primary_key"`
+	Action    string    `json:"action" gorm:"type:text;index"`
+	ActorID   string    `json:"actor_id" gorm:"type:text;index"`
+	SubjectID string    `json:"subject_id" gorm:"type:text;index"`
+	Detail    string    `json:"detail" gorm:"type:text"`
+	CreatedAt time.Time `json:"created_at" gorm:"type:timestamp;autoCreateTime"`
+}
+
+func (a *AuditLog) BeforeCreate(_ *gorm.DB) error {
+	a.ID = uuid.New()
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package audit
+
+import "gorm.io/gorm"
+
+type Repository interface {
+	Create(log *AuditLog) error
+}
+
+type repositoryImpl struct {
+	Db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) Repository {
+	return &repositoryImpl{Db: db}
+}
+
+func (r *repositoryImpl) Create(log *AuditLog) error {
+	return r.Db.Create(log).Error
+}
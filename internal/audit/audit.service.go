@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"go.uber.org/zap"
+)
+
+const (
+	ImpersonationStarted = "impersonation.started"
+)
+
+// Service records security-relevant actions taken by staff. Callers must not go ahead with
+// an action whose record could not be written.
+type Service interface {
+	Record(action string, actorId string, subjectId string, detail string) error
+}
+
+type serviceImpl struct {
+	repo Repository
+	log  *zap.Logger
+}
+
+func NewService(repo Repository, log *zap.Logger) Service {
+	return &serviceImpl{
+		repo: repo,
+		log:  log,
+	}
+}
+
+func (s *serviceImpl) Record(action string, actorId string, subjectId string, detail string) error {
+	err := s.repo.Create(&AuditLog{
+		Action:    action,
+		ActorID:   actorId,
+		SubjectID: subjectId,
+		Detail:    detail,
+	})
+	if err != nil {
+		s.log.Named("Record").Error("Create: ", zap.Error(err), zap.String("action", action), zap.String("actorId", actorId), zap.String("subjectId", subjectId))
+		return err
+	}
+
+	s.log.Named("Record").Info(action, zap.String("actorId", actorId), zap.String("subjectId", subjectId), zap.String("detail", detail))
+
+	return nil
+}
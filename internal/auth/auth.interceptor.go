@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// NewServiceAuthInterceptor requires a machine token from the client credentials flow, sent
+// as "authorization: Bearer <token>", on every call to the given gRPC services.
+func NewServiceAuthInterceptor(tokenSvc token.Service, services []string, log *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !isProtectedMethod(info.FullMethod, services) {
+			return handler(ctx, req)
+		}
+
+		serviceCredentials, err := authenticateService(ctx, tokenSvc)
+		if err != nil {
+			log.Named("ServiceAuth").Warn("invalid service token", zap.String("method", info.FullMethod), zap.Error(err))
+			return nil, apperror.ToStatus(err)
+		}
+
+		log.Named("ServiceAuth").Debug("service authenticated", zap.String("clientId", serviceCredentials.ClientId), zap.String("method", info.FullMethod))
+
+		return handler(ctx, req)
+	}
+}
+
+// authenticateService returns the service client calling with "authorization: Bearer <token>",
+// or InvalidServiceToken when the call carries no valid service token.
+func authenticateService(ctx context.Context, tokenSvc token.Service) (*dto.ServiceCredentials, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 || !strings.HasPrefix(authorization[0], "Bearer ") {
+		return nil, apperror.InvalidServiceToken
+	}
+
+	serviceCredentials, err := tokenSvc.ValidateServiceToken(ctx, strings.TrimPrefix(authorization[0], "Bearer "))
+	if err != nil {
+		return nil, apperror.InvalidServiceToken.Wrap(err)
+	}
+
+	return serviceCredentials, nil
+}
+
+func isProtectedMethod(fullMethod string, services []string) bool {
+	for _, service := range services {
+		if strings.HasPrefix(fullMethod, "/"+service+"/") {
+			return true
+		}
+	}
+
+	return false
+}
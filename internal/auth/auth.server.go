@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ExtServiceName is the gRPC service holding the RPCs that rpkm67-go-proto has no messages for
+// yet. Its messages are the JSON encoded dto types, so clients call it with
+// grpc.CallContentSubtype("json"), e.g.
+//
+//	conn.Invoke(ctx, "/rpkm67.auth.auth.v1.AuthExtService/SignOut", req, res, grpc.CallContentSubtype("json"))
+//
+// A method moves to AuthService once the proto has it.
+const ExtServiceName = "rpkm67.auth.auth.v1.AuthExtService"
+
+var ExtServiceDesc = grpc.ServiceDesc{
+	ServiceName: ExtServiceName,
+	HandlerType: (*Service)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("ClientCredentials", Service.ClientCredentials),
+		unaryMethod("Introspect", Service.Introspect),
+		unaryMethod("SignOut", Service.SignOut),
+		unaryMethod("SignOutAllDevices", Service.SignOutAllDevices),
+		unaryMethod("GrantPermission", Service.GrantPermission),
+		unaryMethod("RevokePermission", Service.RevokePermission),
+		unaryMethod("ListPermissions", Service.ListPermissions),
+		unaryMethod("Impersonate", Service.Impersonate),
+		unaryMethod("CreateQrToken", Service.CreateQrToken),
+		unaryMethod("RedeemQrToken", Service.RedeemQrToken),
+		unaryMethod("GetJwks", Service.GetJwks),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "auth.server.go",
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec lets the dto types travel as gRPC messages with the "json" content subtype.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// unaryMethod is what protoc-gen-go-grpc generates for a unary method, for a Service method
+// taking and returning dto types.
+func unaryMethod[Req any, Res any](name string, call func(Service, context.Context, *Req) (*Res, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(Req)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(Service), ctx, in)
+			}
+
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + ExtServiceName + "/" + name,
+			}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(Service), ctx, req.(*Req))
+			})
+		},
+	}
+}
@@ -2,12 +2,19 @@ package auth
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/audit"
 	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
 	"github.com/isd-sgcu/rpkm67-auth/internal/oauth"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
 	"github.com/isd-sgcu/rpkm67-auth/internal/token"
 	"github.com/isd-sgcu/rpkm67-auth/internal/user"
 	proto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/auth/v1"
@@ -15,42 +22,81 @@ import (
 	"github.com/isd-sgcu/rpkm67-model/constant"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 type Service interface {
 	proto.AuthServiceServer
+	ClientCredentials(ctx context.Context, in *dto.ClientCredentialsRequest) (*dto.ClientCredentialsResponse, error)
+	Introspect(ctx context.Context, in *dto.IntrospectRequest) (*dto.IntrospectResponse, error)
+	SignOut(ctx context.Context, in *dto.SignOutRequest) (*dto.SignOutResponse, error)
+	SignOutAllDevices(ctx context.Context, in *dto.SignOutAllDevicesRequest) (*dto.SignOutAllDevicesResponse, error)
+	GrantPermission(ctx context.Context, in *dto.PermissionRequest) (*dto.PermissionResponse, error)
+	RevokePermission(ctx context.Context, in *dto.PermissionRequest) (*dto.PermissionResponse, error)
+	ListPermissions(ctx context.Context, in *dto.ListPermissionsRequest) (*dto.ListPermissionsResponse, error)
+	// Impersonate issues a short-lived, non-refreshable token for another user to a staff member
+	// with the user:impersonate permission. Every use is written to the audit log.
+	Impersonate(ctx context.Context, in *dto.ImpersonateRequest) (*dto.ImpersonateResponse, error)
+	CreateQrToken(ctx context.Context, in *dto.CreateQrTokenRequest) (*dto.CreateQrTokenResponse, error)
+	// RedeemQrToken is called by the scanning service, e.g. checkin, with its service token and
+	// succeeds once per token.
+	RedeemQrToken(ctx context.Context, in *dto.RedeemQrTokenRequest) (*dto.RedeemQrTokenResponse, error)
+	// GetJwks returns the same JWKS document as the HTTP endpoint, for verifiers that only
+	// speak gRPC.
+	GetJwks(ctx context.Context, in *dto.GetJwksRequest) (*dto.JWKS, error)
 }
 
 type serviceImpl struct {
 	proto.UnimplementedAuthServiceServer
-	conf        *config.AuthConfig
-	oauthConfig *oauth2.Config
-	oauthClient oauth.GoogleOauthClient
-	userSvc     user.Service
-	tokenSvc    token.Service
-	utils       AuthUtils
-	log         *zap.Logger
+	conf          *config.AuthConfig
+	oauthConfig   *oauth2.Config
+	oauthClient   oauth.GoogleOauthClient
+	oauthStates   oauth.StateStore
+	userSvc       user.Service
+	tokenSvc      token.Service
+	permissionSvc permission.Service
+	auditSvc      audit.Service
+	keys          jwt.KeyStore
+	utils         AuthUtils
+	bcryptUtils   BcryptUtils
+	log           *zap.Logger
 }
 
-func NewService(conf *config.AuthConfig, oauthConfig *oauth2.Config, oauthClient oauth.GoogleOauthClient, userSvc user.Service, tokenSvc token.Service, utils AuthUtils, log *zap.Logger) Service {
+func NewService(conf *config.AuthConfig, oauthConfig *oauth2.Config, oauthClient oauth.GoogleOauthClient, oauthStates oauth.StateStore, userSvc user.Service, tokenSvc token.Service, permissionSvc permission.Service, auditSvc audit.Service, keys jwt.KeyStore, utils AuthUtils, bcryptUtils BcryptUtils, log *zap.Logger) Service {
 	return &serviceImpl{
-		conf:        conf,
-		oauthConfig: oauthConfig,
-		oauthClient: oauthClient,
-		userSvc:     userSvc,
-		tokenSvc:    tokenSvc,
-		utils:       utils,
-		log:         log,
+		conf:          conf,
+		oauthConfig:   oauthConfig,
+		oauthClient:   oauthClient,
+		oauthStates:   oauthStates,
+		userSvc:       userSvc,
+		tokenSvc:      tokenSvc,
+		permissionSvc: permissionSvc,
+		auditSvc:      auditSvc,
+		keys:          keys,
+		utils:         utils,
+		bcryptUtils:   bcryptUtils,
+		log:           log,
 	}
 }
 
-func (s *serviceImpl) Validate(_ context.Context, in *proto.ValidateRequest) (res *proto.ValidateResponse, err error) {
-	userCredentials, err := s.tokenSvc.ValidateToken(in.AccessToken)
+func (s *serviceImpl) Validate(ctx context.Context, in *proto.ValidateRequest) (res *proto.ValidateResponse, err error) {
+	userCredentials, err := s.tokenSvc.ValidateToken(ctx, in.AccessToken, ExpectedAudienceFromContext(ctx))
 	if err != nil {
 		s.log.Named("Validate").Error("ValidateToken: ", zap.Error(err))
-		return nil, status.Error(codes.Unauthenticated, err.Error())
+		return nil, apperror.ToStatus(err)
+	}
+
+	// the proto response has no room for scopes yet, so they are sent as a header
+	header := metadata.Pairs("x-scopes", strings.Join(userCredentials.Scopes, " "))
+	if userCredentials.ActorID != "" {
+		header.Set("x-actor-id", userCredentials.ActorID)
+	}
+	err = grpc.SetHeader(ctx, header)
+	if err != nil {
+		s.log.Named("Validate").Warn("SetHeader: ", zap.Error(err))
 	}
 
 	return &proto.ValidateResponse{
@@ -59,11 +105,11 @@ func (s *serviceImpl) Validate(_ context.Context, in *proto.ValidateRequest) (re
 	}, nil
 }
 
-func (s *serviceImpl) RefreshToken(_ context.Context, in *proto.RefreshTokenRequest) (res *proto.RefreshTokenResponse, err error) {
-	credentials, err := s.tokenSvc.RefreshToken(in.RefreshToken)
+func (s *serviceImpl) RefreshToken(ctx context.Context, in *proto.RefreshTokenRequest) (res *proto.RefreshTokenResponse, err error) {
+	credentials, err := s.tokenSvc.RefreshToken(ctx, in.RefreshToken)
 	if err != nil {
 		s.log.Named("RefreshToken").Error("RefreshToken: ", zap.Error(err))
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, apperror.ToStatus(err)
 	}
 
 	return &proto.RefreshTokenResponse{
@@ -71,55 +117,357 @@ func (s *serviceImpl) RefreshToken(_ context.Context, in *proto.RefreshTokenRequ
 	}, nil
 }
 
-func (s *serviceImpl) GetGoogleLoginUrl(_ context.Context, in *proto.GetGoogleLoginUrlRequest) (res *proto.GetGoogleLoginUrlResponse, err error) {
+// ClientCredentials authenticates a registered rpkm67 service with its client id and secret
+// and returns a short-lived machine token for calling UserService.
+func (s *serviceImpl) ClientCredentials(ctx context.Context, in *dto.ClientCredentialsRequest) (res *dto.ClientCredentialsResponse, err error) {
+	hashedSecret, ok := s.conf.ServiceClients[in.ClientId]
+	if !ok || s.bcryptUtils.CompareHashedPassword(hashedSecret, in.ClientSecret) != nil {
+		s.log.Named("ClientCredentials").Warn("invalid client credentials", zap.String("clientId", in.ClientId))
+		return nil, apperror.ToStatus(apperror.InvalidClient)
+	}
+
+	credentials, err := s.tokenSvc.CreateServiceToken(ctx, in.ClientId)
+	if err != nil {
+		s.log.Named("ClientCredentials").Error("CreateServiceToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.ClientCredentialsResponse{
+		AccessToken: credentials.AccessToken,
+		ExpiresIn:   credentials.ExpiresIn,
+	}, nil
+}
+
+// Introspect never fails for an unusable token; it reports it with Active set to false. Only
+// services with a service token may call it, as RFC 7662 requires the caller to authenticate.
+func (s *serviceImpl) Introspect(ctx context.Context, in *dto.IntrospectRequest) (res *dto.IntrospectResponse, err error) {
+	serviceCredentials, err := authenticateService(ctx, s.tokenSvc)
+	if err != nil {
+		s.log.Named("Introspect").Warn("authenticateService: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	if in.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "No token is provided")
+	}
+
+	introspection := s.tokenSvc.IntrospectToken(ctx, in.Token, in.TokenTypeHint)
+	s.log.Named("Introspect").Debug("token introspected", zap.String("clientId", serviceCredentials.ClientId), zap.Bool("active", introspection.Active))
+
+	return &dto.IntrospectResponse{
+		TokenIntrospection: *introspection,
+	}, nil
+}
+
+func (s *serviceImpl) SignOut(ctx context.Context, in *dto.SignOutRequest) (res *dto.SignOutResponse, err error) {
+	userCredentials, err := s.tokenSvc.ValidateToken(ctx, in.AccessToken, "")
+	if err != nil {
+		s.log.Named("SignOut").Error("ValidateToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	// only users sign themselves out; an impersonation token simply expires
+	if userCredentials.ActorID != "" {
+		s.log.Named("SignOut").Warn("impersonation token used to sign out", zap.String("userId", userCredentials.UserID), zap.String("actorId", userCredentials.ActorID))
+		return nil, apperror.ToStatus(apperror.ImpersonationForbidden)
+	}
+
+	err = s.tokenSvc.RevokeSession(ctx, userCredentials.SessionID)
+	if err != nil {
+		s.log.Named("SignOut").Error("RevokeSession: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.SignOutResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *serviceImpl) SignOutAllDevices(ctx context.Context, in *dto.SignOutAllDevicesRequest) (res *dto.SignOutAllDevicesResponse, err error) {
+	userCredentials, err := s.tokenSvc.ValidateToken(ctx, in.AccessToken, "")
+	if err != nil {
+		s.log.Named("SignOutAllDevices").Error("ValidateToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	// only users sign themselves out; an impersonation token simply expires
+	if userCredentials.ActorID != "" {
+		s.log.Named("SignOutAllDevices").Warn("impersonation token used to sign out", zap.String("userId", userCredentials.UserID), zap.String("actorId", userCredentials.ActorID))
+		return nil, apperror.ToStatus(apperror.ImpersonationForbidden)
+	}
+
+	err = s.tokenSvc.RevokeAllSessions(ctx, userCredentials.UserID)
+	if err != nil {
+		s.log.Named("SignOutAllDevices").Error("RevokeAllSessions: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.SignOutAllDevicesResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *serviceImpl) GrantPermission(ctx context.Context, in *dto.PermissionRequest) (res *dto.PermissionResponse, err error) {
+	if _, err := s.authorize(ctx, in.AccessToken, permission.ManagePermissions); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case in.Role != "" && in.UserId == "":
+		err = s.permissionSvc.GrantRolePermission(constant.Role(in.Role), in.Permission)
+	case in.UserId != "" && in.Role == "":
+		err = s.permissionSvc.GrantUserPermission(in.UserId, in.Permission)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Exactly one of role or user id must be provided")
+	}
+	if err != nil {
+		s.log.Named("GrantPermission").Error("Grant: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.PermissionResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *serviceImpl) RevokePermission(ctx context.Context, in *dto.PermissionRequest) (res *dto.PermissionResponse, err error) {
+	if _, err := s.authorize(ctx, in.AccessToken, permission.ManagePermissions); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case in.Role != "" && in.UserId == "":
+		err = s.permissionSvc.RevokeRolePermission(constant.Role(in.Role), in.Permission)
+	case in.UserId != "" && in.Role == "":
+		err = s.permissionSvc.RevokeUserPermission(in.UserId, in.Permission)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Exactly one of role or user id must be provided")
+	}
+	if err != nil {
+		s.log.Named("RevokePermission").Error("Revoke: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	// a revoked permission is still in the scopes of tokens already issued until they are revoked
+	if in.UserId != "" {
+		err = s.tokenSvc.RevokeAllSessions(ctx, in.UserId)
+		if err != nil {
+			s.log.Named("RevokePermission").Error("RevokeAllSessions: ", zap.Error(err))
+			return nil, apperror.ToStatus(err)
+		}
+	} else {
+		err = s.tokenSvc.RevokeRoleTokens(ctx, constant.Role(in.Role))
+		if err != nil {
+			s.log.Named("RevokePermission").Error("RevokeRoleTokens: ", zap.Error(err))
+			return nil, apperror.ToStatus(err)
+		}
+	}
+
+	return &dto.PermissionResponse{
+		Success: true,
+	}, nil
+}
+
+func (s *serviceImpl) ListPermissions(ctx context.Context, in *dto.ListPermissionsRequest) (res *dto.ListPermissionsResponse, err error) {
+	if _, err := s.authorize(ctx, in.AccessToken, permission.ManagePermissions); err != nil {
+		return nil, err
+	}
+
+	var permissions []string
+	switch {
+	case in.Role != "" && in.UserId == "":
+		permissions, err = s.permissionSvc.ListRolePermissions(constant.Role(in.Role))
+	case in.UserId != "" && in.Role == "":
+		permissions, err = s.permissionSvc.ListUserPermissions(in.UserId)
+	default:
+		return nil, status.Error(codes.InvalidArgument, "Exactly one of role or user id must be provided")
+	}
+	if err != nil {
+		s.log.Named("ListPermissions").Error("List: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.ListPermissionsResponse{
+		Permissions: permissions,
+	}, nil
+}
+
+func (s *serviceImpl) Impersonate(ctx context.Context, in *dto.ImpersonateRequest) (res *dto.ImpersonateResponse, err error) {
+	actor, err := s.authorize(ctx, in.AccessToken, permission.ImpersonateUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "No user id is provided")
+	}
+	if in.UserId == actor.UserID {
+		return nil, status.Error(codes.InvalidArgument, "Cannot impersonate yourself")
+	}
+
+	user, err := s.userSvc.FindOne(context.Background(), &userProto.FindOneUserRequest{Id: in.UserId})
+	if err != nil {
+		s.log.Named("Impersonate").Error("FindOne: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	// the token carries the target's scopes, so a privileged target would lend them to the actor
+	targetPermissions, err := s.permissionSvc.GetPermissions(user.User.Id, constant.Role(user.User.Role))
+	if err != nil {
+		s.log.Named("Impersonate").Error("GetPermissions: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+	if slices.Contains(targetPermissions, permission.ManagePermissions) || slices.Contains(targetPermissions, permission.ImpersonateUsers) {
+		s.log.Named("Impersonate").Warn("impersonation of a privileged user refused", zap.String("actorId", actor.UserID), zap.String("userId", user.User.Id))
+		return nil, apperror.ToStatus(apperror.PrivilegedUser)
+	}
+
+	// the audit record is written first so that no impersonation goes unrecorded
+	err = s.auditSvc.Record(audit.ImpersonationStarted, actor.UserID, user.User.Id, in.Reason)
+	if err != nil {
+		s.log.Named("Impersonate").Error("Record: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	credentials, err := s.tokenSvc.CreateImpersonationCredentials(ctx, user.User.Id, constant.Role(user.User.Role), actor.UserID)
+	if err != nil {
+		s.log.Named("Impersonate").Error("CreateImpersonationCredentials: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.ImpersonateResponse{
+		AccessToken: credentials.AccessToken,
+		ExpiresIn:   credentials.ExpiresIn,
+	}, nil
+}
+
+func (s *serviceImpl) CreateQrToken(ctx context.Context, in *dto.CreateQrTokenRequest) (res *dto.CreateQrTokenResponse, err error) {
+	if in.Purpose == "" {
+		return nil, status.Error(codes.InvalidArgument, "No purpose is provided")
+	}
+
+	userCredentials, err := s.tokenSvc.ValidateToken(ctx, in.AccessToken, ExpectedAudienceFromContext(ctx))
+	if err != nil {
+		s.log.Named("CreateQrToken").Error("ValidateToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	qrToken, err := s.tokenSvc.CreateQrToken(ctx, userCredentials.UserID, in.Purpose)
+	if err != nil {
+		s.log.Named("CreateQrToken").Error("CreateQrToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	return &dto.CreateQrTokenResponse{
+		Token:     qrToken.Token,
+		ExpiresIn: qrToken.ExpiresIn,
+	}, nil
+}
+
+func (s *serviceImpl) RedeemQrToken(ctx context.Context, in *dto.RedeemQrTokenRequest) (res *dto.RedeemQrTokenResponse, err error) {
+	serviceCredentials, err := authenticateService(ctx, s.tokenSvc)
+	if err != nil {
+		s.log.Named("RedeemQrToken").Warn("authenticateService: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	if in.Token == "" || in.Purpose == "" {
+		return nil, status.Error(codes.InvalidArgument, "Token and purpose must be provided")
+	}
+
+	redemption, err := s.tokenSvc.RedeemQrToken(ctx, in.Token, in.Purpose)
+	if err != nil {
+		s.log.Named("RedeemQrToken").Error("RedeemQrToken: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	s.log.Named("RedeemQrToken").Info("qr token redeemed", zap.String("clientId", serviceCredentials.ClientId), zap.String("purpose", in.Purpose), zap.String("userId", redemption.UserID))
+
+	return &dto.RedeemQrTokenResponse{
+		UserId: redemption.UserID,
+	}, nil
+}
+
+// GetJwks sends the max age of the document as the "cache-control" header, as the HTTP
+// endpoint does.
+func (s *serviceImpl) GetJwks(ctx context.Context, _ *dto.GetJwksRequest) (res *dto.JWKS, err error) {
+	err = grpc.SetHeader(ctx, metadata.Pairs("cache-control", fmt.Sprintf("public, max-age=%d", s.tokenSvc.GetConfig().JwksMaxAge)))
+	if err != nil {
+		s.log.Named("GetJwks").Warn("SetHeader: ", zap.Error(err))
+	}
+
+	return jwt.BuildJwks(s.keys.VerificationKeys()), nil
+}
+
+// GetGoogleLoginUrl starts a login attempt bound to the "x-oauth-binding" of the browser. The
+// proto response has no room for the state yet, so besides being in the URL it is sent as the
+// "x-oauth-state" header.
+func (s *serviceImpl) GetGoogleLoginUrl(ctx context.Context, in *proto.GetGoogleLoginUrlRequest) (res *proto.GetGoogleLoginUrlResponse, err error) {
 	URL, err := url.Parse(s.oauthConfig.Endpoint.AuthURL)
 	if err != nil {
 		s.log.Named("GetGoogleLoginUrl").Error("Parse: ", zap.Error(err))
 		return nil, status.Error(codes.Internal, "Cannot parse Google OAuth URL")
 	}
+
+	state, attempt, err := s.oauthStates.Create(ctx, OauthBindingFromContext(ctx))
+	if errors.Is(err, apperror.MissingOauthBinding) {
+		return nil, apperror.ToStatus(err)
+	} else if err != nil {
+		s.log.Named("GetGoogleLoginUrl").Error("Create: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
 	parameters := url.Values{}
 	parameters.Add("client_id", s.oauthConfig.ClientID)
 	parameters.Add("scope", strings.Join(s.oauthConfig.Scopes, " "))
 	parameters.Add("redirect_uri", s.oauthConfig.RedirectURL)
 	parameters.Add("response_type", "code")
+	parameters.Add("state", state)
+	parameters.Add("code_challenge", oauth2.S256ChallengeFromVerifier(attempt.CodeVerifier))
+	parameters.Add("code_challenge_method", "S256")
 	URL.RawQuery = parameters.Encode()
 	url := URL.String()
 
+	err = grpc.SetHeader(ctx, metadata.Pairs("x-oauth-state", state))
+	if err != nil {
+		s.log.Named("GetGoogleLoginUrl").Warn("SetHeader: ", zap.Error(err))
+	}
+
 	return &proto.GetGoogleLoginUrlResponse{
 		Url: url,
 	}, nil
 }
 
-func (s *serviceImpl) VerifyGoogleLogin(_ context.Context, in *proto.VerifyGoogleLoginRequest) (res *proto.VerifyGoogleLoginResponse, err error) {
+// VerifyGoogleLogin finishes a login attempt. The gateway forwards the state Google redirected
+// back with as "x-oauth-state", as the proto request has no room for it yet, and the
+// "x-oauth-binding" of the browser it redirected.
+func (s *serviceImpl) VerifyGoogleLogin(ctx context.Context, in *proto.VerifyGoogleLoginRequest) (res *proto.VerifyGoogleLoginResponse, err error) {
 	code := in.Code
 	if code == "" {
 		return nil, status.Error(codes.InvalidArgument, "No code is provided")
 	}
 
-	email, err := s.oauthClient.GetUserEmail(code)
+	// the attempt is consumed before the exchange, so a code can only be tried once per login
+	attempt, err := s.oauthStates.Consume(ctx, OauthStateFromContext(ctx), OauthBindingFromContext(ctx))
+	if err != nil {
+		s.log.Named("VerifyGoogleLogin").Warn("Consume: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
+	}
+
+	email, err := s.oauthClient.GetUserEmail(ctx, code, attempt.CodeVerifier)
 	if err != nil {
 		s.log.Named("VerifyGoogleLogin").Error("GetUserEmail: ", zap.Error(err))
-		switch err.Error() {
-		case "Invalid code":
-			return nil, status.Error(codes.InvalidArgument, "Invalid code")
-		default:
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, apperror.ToStatus(err)
 	}
 
 	if s.conf.CheckChulaEmail && !IsEmailChulaStudent(email) {
-		return nil, status.Error(codes.Unauthenticated, "Email is not a Chula student")
+		return nil, apperror.ToStatus(apperror.NotChulaStudent)
 	}
 
 	user, err := s.userSvc.FindByEmail(context.Background(), &userProto.FindByEmailRequest{Email: email})
 	if err != nil {
-		st, ok := status.FromError(err)
-		if !ok {
-			s.log.Named("VerifyGoogleLogin").Error("FindByEmail: ", zap.Error(err))
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-		switch st.Code() {
-		case codes.NotFound:
+		switch {
+		case errors.Is(err, apperror.UserNotFound):
 			s.log.Named("VerifyGoogleLogin").Info("User not found, creating new user")
 			role := "user"
 			if s.utils.IsStudentIdInMap(email) {
@@ -134,13 +482,13 @@ func (s *serviceImpl) VerifyGoogleLogin(_ context.Context, in *proto.VerifyGoogl
 			createdUser, err := s.userSvc.Create(context.Background(), createUser)
 			if err != nil {
 				s.log.Named("VerifyGoogleLogin").Error("Create: ", zap.Error(err))
-				return nil, err
+				return nil, apperror.ToStatus(err)
 			}
 
-			credentials, err := s.tokenSvc.GetCredentials(createdUser.User.Id, constant.Role(createdUser.User.Role))
+			credentials, err := s.tokenSvc.CreateCredentials(ctx, createdUser.User.Id, constant.Role(createdUser.User.Role), ClientFromContext(ctx))
 			if err != nil {
-				s.log.Named("VerifyGoogleLogin").Error("GetCredentials: ", zap.Error(err))
-				return nil, status.Error(codes.Internal, err.Error())
+				s.log.Named("VerifyGoogleLogin").Error("CreateCredentials: ", zap.Error(err))
+				return nil, apperror.ToStatus(err)
 			}
 
 			return &proto.VerifyGoogleLoginResponse{
@@ -150,14 +498,14 @@ func (s *serviceImpl) VerifyGoogleLogin(_ context.Context, in *proto.VerifyGoogl
 
 		default:
 			s.log.Named("VerifyGoogleLogin").Error("FindByEmail: ", zap.Error(err))
-			return nil, err
+			return nil, apperror.ToStatus(err)
 		}
 	}
 
-	credentials, err := s.tokenSvc.GetCredentials(user.User.Id, constant.Role(user.User.Role))
+	credentials, err := s.tokenSvc.CreateCredentials(ctx, user.User.Id, constant.Role(user.User.Role), ClientFromContext(ctx))
 	if err != nil {
-		s.log.Named("VerifyGoogleLogin").Error("GetCredentials: ", zap.Error(err))
-		return nil, status.Error(codes.Internal, err.Error())
+		s.log.Named("VerifyGoogleLogin").Error("CreateCredentials: ", zap.Error(err))
+		return nil, apperror.ToStatus(err)
 	}
 
 	return &proto.VerifyGoogleLoginResponse{
@@ -167,6 +515,27 @@ func (s *serviceImpl) VerifyGoogleLogin(_ context.Context, in *proto.VerifyGoogl
 
 }
 
+// authorize checks that the access token is valid and carries the given permission. Tokens
+// obtained through impersonation are never allowed to manage anything.
+func (s *serviceImpl) authorize(ctx context.Context, accessToken string, scope string) (*dto.UserCredentials, error) {
+	userCredentials, err := s.tokenSvc.ValidateToken(ctx, accessToken, "")
+	if err != nil {
+		return nil, apperror.ToStatus(err)
+	}
+
+	if userCredentials.ActorID != "" {
+		s.log.Named("authorize").Warn("impersonation token used for a privileged call", zap.String("userId", userCredentials.UserID), zap.String("actorId", userCredentials.ActorID), zap.String("scope", scope))
+		return nil, apperror.ToStatus(apperror.ImpersonationForbidden)
+	}
+
+	if !slices.Contains(userCredentials.Scopes, scope) {
+		s.log.Named("authorize").Warn("missing permission", zap.String("userId", userCredentials.UserID), zap.String("scope", scope))
+		return nil, apperror.ToStatus(apperror.MissingPermission.With("permission", scope))
+	}
+
+	return userCredentials, nil
+}
+
 func (s *serviceImpl) dtoToProtoCredential(dto *dto.Credentials) *proto.Credential {
 	return &proto.Credential{
 		AccessToken:  dto.AccessToken,
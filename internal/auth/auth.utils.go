@@ -1,12 +1,18 @@
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"google.golang.org/grpc/metadata"
 )
 
+const maxDeviceLength = 128
+
 type AuthUtils interface {
 	IsStudentIdInMap(studentId string) bool
 }
@@ -47,6 +53,61 @@ func (u *authUtilsImpl) IsStudentIdInMap(email string) bool {
 	return ok
 }
 
+// ClientFromContext reads the client a login comes from out of the request metadata. The
+// gateway forwards "x-client-id" and the requested "x-audience", and can name the device
+// with "x-device-name"; otherwise the user agent is used.
+func ClientFromContext(ctx context.Context) *dto.ClientInfo {
+	client := &dto.ClientInfo{
+		Device:   firstMetadataValue(ctx, "x-device-name", "user-agent"),
+		ClientId: firstMetadataValue(ctx, "x-client-id"),
+	}
+
+	if len(client.Device) > maxDeviceLength {
+		client.Device = client.Device[:maxDeviceLength]
+	}
+
+	for _, audience := range strings.Split(firstMetadataValue(ctx, "x-audience"), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			client.Audience = append(client.Audience, audience)
+		}
+	}
+
+	return client
+}
+
+// ExpectedAudienceFromContext returns the audience the calling service expects the validated
+// token to be issued for.
+func ExpectedAudienceFromContext(ctx context.Context) string {
+	return firstMetadataValue(ctx, "x-expected-audience")
+}
+
+// OauthStateFromContext returns the state of the Google login attempt being verified.
+func OauthStateFromContext(ctx context.Context) string {
+	return firstMetadataValue(ctx, "x-oauth-state")
+}
+
+// OauthBindingFromContext returns the value that ties a Google login attempt to the browser
+// that started it. The gateway keeps it in an HttpOnly cookie and forwards it as
+// "x-oauth-binding" both when the login starts and when it is verified.
+func OauthBindingFromContext(ctx context.Context) string {
+	return firstMetadataValue(ctx, "x-oauth-binding")
+}
+
+func firstMetadataValue(ctx context.Context, keys ...string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	for _, key := range keys {
+		if values := md.Get(key); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
 func extractStudentIdFromEmail(email string) string {
 	// Example: "6932203021@student.chula.ac.th" -> "6932203021"
 	return email[:10]
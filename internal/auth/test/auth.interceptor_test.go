@@ -0,0 +1,69 @@
+package test
+
+import (
+	"context"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/auth"
+	userProto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/user/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// intercept runs a call to fullMethod through the service auth interceptor, protecting the
+// user service, and reports whether it reached the handler.
+func (t *AuthServiceTest) intercept(fullMethod string, authorization string) (bool, error) {
+	interceptor := auth.NewServiceAuthInterceptor(t.tokenSvc, []string{userProto.UserService_ServiceDesc.ServiceName}, t.logger)
+
+	ctx := t.ctx
+	if authorization != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", authorization))
+	}
+
+	handled := false
+	_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, func(context.Context, interface{}) (interface{}, error) {
+		handled = true
+		return nil, nil
+	})
+
+	return handled, err
+}
+
+func (t *AuthServiceTest) TestInterceptorAcceptsServiceToken() {
+	credentials, err := t.tokenSvc.CreateServiceToken(t.ctx, "checkin")
+	t.Require().NoError(err)
+
+	handled, err := t.intercept("/rpkm67.auth.user.v1.UserService/FindOne", "Bearer "+credentials.AccessToken)
+	t.NoError(err)
+	t.True(handled)
+}
+
+func (t *AuthServiceTest) TestInterceptorRejectsMissingOrInvalidToken() {
+	user := t.login("user-id")
+
+	for _, authorization := range []string{
+		"",
+		"Basic Y2hlY2tpbjpzZWNyZXQ=",
+		"Bearer invalid",
+		// a user's access token is not a service token
+		"Bearer " + user.AccessToken,
+	} {
+		handled, err := t.intercept("/rpkm67.auth.user.v1.UserService/FindOne", authorization)
+		t.Equal(codes.Unauthenticated, status.Code(err), authorization)
+		t.False(handled, authorization)
+	}
+}
+
+func (t *AuthServiceTest) TestInterceptorSkipsUnprotectedServices() {
+	for _, fullMethod := range []string{
+		"/rpkm67.auth.auth.v1.AuthService/SignIn",
+		"/" + auth.ExtServiceName + "/ClientCredentials",
+		// a service whose name only starts with a protected one
+		"/rpkm67.auth.user.v1.UserServiceAdmin/FindOne",
+	} {
+		handled, err := t.intercept(fullMethod, "")
+		t.NoError(err, fullMethod)
+		t.True(handled, fullMethod)
+	}
+}
@@ -1,23 +1,656 @@
 package test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/audit"
+	"github.com/isd-sgcu/rpkm67-auth/internal/auth"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/isd-sgcu/rpkm67-auth/internal/oauth"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	"github.com/isd-sgcu/rpkm67-auth/internal/user"
+	mock_permission "github.com/isd-sgcu/rpkm67-auth/mocks/permission"
+	mock_user "github.com/isd-sgcu/rpkm67-auth/mocks/user"
+	authProto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/auth/v1"
+	userProto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/user/v1"
+	"github.com/isd-sgcu/rpkm67-model/constant"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
+const (
+	adminId = "9a3c6b1e-8d5f-4f0a-b2c7-1e4d6f8a0b3c"
+	staffId = "5e7f9a1b-3c4d-4e6f-8a0b-2c4e6f8a1b3d"
+)
+
+// userService completes the generated mock, which lacks the method proto.UserServiceServer
+// requires implementations to embed.
+type userService struct {
+	*mock_user.MockService
+	unimplementedUserService
+}
+
+type unimplementedUserService struct {
+	userProto.UnimplementedUserServiceServer
+}
+
+var _ user.Service = userService{}
+
+// auditLog keeps audit records in memory.
+type auditLog struct {
+	records []string
+}
+
+func (a *auditLog) Record(action string, actorId string, subjectId string, detail string) error {
+	a.records = append(a.records, fmt.Sprintf("%s %s %s %s", action, actorId, subjectId, detail))
+	return nil
+}
+
+// googleOauth stands in for Google, handing out the email of whoever signs in.
+type googleOauth struct {
+	email         string
+	codeVerifiers []string
+}
+
+func (g *googleOauth) GetUserEmail(ctx context.Context, code string, codeVerifier string) (string, error) {
+	g.codeVerifiers = append(g.codeVerifiers, codeVerifier)
+	return g.email, nil
+}
+
+// AuthServiceTest runs the auth service against a real token service on the in-memory cache,
+// so calls go through the same token lifecycle as in production.
 type AuthServiceTest struct {
 	suite.Suite
-	// controller *gomock.Controller
-	// logger     *zap.Logger
+	controller     *gomock.Controller
+	jwtConf        config.JwtConfig
+	authConf       config.AuthConfig
+	cache          cache.Repository
+	userSvc        *mock_user.MockService
+	permissionRepo *mock_permission.MockRepository
+	// rolePermissions and userPermissions back permissionRepo
+	rolePermissions map[constant.Role][]string
+	userPermissions map[string][]string
+	audit           *auditLog
+	google          *googleOauth
+	permissionSvc   permission.Service
+	tokenSvc        token.Service
+	svc             auth.Service
+	ctx             context.Context
+	logger          *zap.Logger
 }
 
 func TestAuthService(t *testing.T) {
 	suite.Run(t, new(AuthServiceTest))
 }
 
-func (t *AuthServiceTest) SetupTest() {}
+func (t *AuthServiceTest) SetupTest() {
+	t.controller = gomock.NewController(t.T())
+	t.jwtConf = config.JwtConfig{
+		Secret:             "secret",
+		AccessTTL:          3600,
+		RefreshTTL:         259200,
+		Issuer:             "issuer",
+		RefreshGracePeriod: 10,
+		ServiceTokenTTL:    300,
+		QrTokenTTL:         60,
+		JwksMaxAge:         300,
+	}
+	t.authConf = config.AuthConfig{AdminUserIds: []string{adminId}}
+	t.cache = cache.NewMemoryRepository(cache.Options{})
+	t.userSvc = mock_user.NewMockService(t.controller)
+	t.permissionRepo = mock_permission.NewMockRepository(t.controller)
+	t.rolePermissions = map[constant.Role][]string{}
+	t.userPermissions = map[string][]string{}
+	t.expectPermissionRepo()
+	t.audit = &auditLog{}
+	t.google = &googleOauth{email: "6732100021@student.chula.ac.th"}
+	t.ctx = context.Background()
+	t.logger = zap.NewNop()
+
+	keys, err := jwt.NewKeyStore(t.jwtConf)
+	t.Require().NoError(err)
+	codec, err := jwt.NewCodec(t.jwtConf.TokenFormat, keys, jwt.NewJwtStrategy(keys), jwt.NewJwtUtils())
+	t.Require().NoError(err)
+
+	t.permissionSvc = permission.NewService(&t.authConf, t.permissionRepo, t.logger)
+	t.tokenSvc = token.NewService(
+		jwt.NewService(t.jwtConf, codec, t.logger),
+		t.permissionSvc,
+		t.cache,
+		token.NewRevocationList(t.cache, t.jwtConf.RevocationRetention(), t.logger),
+		token.NewValidationCache(0, 0),
+		token.NewTokenUtils(),
+		t.logger,
+	)
+	t.svc = t.newService(keys)
+}
+
+func (t *AuthServiceTest) newService(keys jwt.KeyStore) auth.Service {
+	return auth.NewService(
+		&t.authConf,
+		&oauth2.Config{Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.google.com/o/oauth2/auth"}},
+		t.google,
+		oauth.NewStateStore(t.cache, 60),
+		userService{MockService: t.userSvc},
+		t.tokenSvc,
+		t.permissionSvc,
+		t.audit,
+		keys,
+		nil,
+		auth.NewBcryptUtils(),
+		t.logger,
+	)
+}
+
+// expectPermissionRepo keeps the permissions granted through permissionRepo in memory.
+func (t *AuthServiceTest) expectPermissionRepo() {
+	t.permissionRepo.EXPECT().FindByRole(gomock.Any(), gomock.Any()).DoAndReturn(func(role constant.Role, out *[]permission.RolePermission) error {
+		for _, p := range t.rolePermissions[role] {
+			*out = append(*out, permission.RolePermission{Role: role, Permission: p})
+		}
+		return nil
+	}).AnyTimes()
+	t.permissionRepo.EXPECT().FindByUser(gomock.Any(), gomock.Any()).DoAndReturn(func(userId string, out *[]permission.UserPermission) error {
+		for _, p := range t.userPermissions[userId] {
+			*out = append(*out, permission.UserPermission{Permission: p})
+		}
+		return nil
+	}).AnyTimes()
+	t.permissionRepo.EXPECT().CreateRolePermission(gomock.Any()).DoAndReturn(func(p *permission.RolePermission) error {
+		t.rolePermissions[p.Role] = append(t.rolePermissions[p.Role], p.Permission)
+		return nil
+	}).AnyTimes()
+	t.permissionRepo.EXPECT().DeleteRolePermission(gomock.Any(), gomock.Any()).DoAndReturn(func(role constant.Role, p string) error {
+		t.rolePermissions[role] = slices.DeleteFunc(t.rolePermissions[role], func(granted string) bool { return granted == p })
+		return nil
+	}).AnyTimes()
+	t.permissionRepo.EXPECT().CreateUserPermission(gomock.Any()).DoAndReturn(func(p *permission.UserPermission) error {
+		t.userPermissions[p.UserID.String()] = append(t.userPermissions[p.UserID.String()], p.Permission)
+		return nil
+	}).AnyTimes()
+	t.permissionRepo.EXPECT().DeleteUserPermission(gomock.Any(), gomock.Any()).DoAndReturn(func(userId string, p string) error {
+		t.userPermissions[userId] = slices.DeleteFunc(t.userPermissions[userId], func(granted string) bool { return granted == p })
+		return nil
+	}).AnyTimes()
+}
+
+// invoke calls method of the ext service over a real gRPC connection.
+func (t *AuthServiceTest) invoke(ctx context.Context, method string, in interface{}, out interface{}, opts ...grpc.CallOption) error {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	server.RegisterService(&auth.ExtServiceDesc, t.svc)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	t.Require().NoError(err)
+	defer conn.Close()
+
+	return conn.Invoke(ctx, "/"+auth.ExtServiceName+"/"+method, in, out, append(opts, grpc.CallContentSubtype("json"))...)
+}
+
+func (t *AuthServiceTest) login(userId string) *dto.Credentials {
+	return t.loginAs(userId, constant.USER)
+}
+
+func (t *AuthServiceTest) loginAs(userId string, role constant.Role) *dto.Credentials {
+	credentials, err := t.tokenSvc.CreateCredentials(t.ctx, userId, role, &dto.ClientInfo{})
+	t.Require().NoError(err)
+
+	return credentials
+}
+
+// asService returns a context calling with a service token of the given client.
+func (t *AuthServiceTest) asService(clientId string) context.Context {
+	credentials, err := t.tokenSvc.CreateServiceToken(t.ctx, clientId)
+	t.Require().NoError(err)
+
+	return metadata.AppendToOutgoingContext(t.ctx, "authorization", "Bearer "+credentials.AccessToken)
+}
 
 func (t *AuthServiceTest) TestSignUpSuccess() {
 
 }
+
+func (t *AuthServiceTest) TestSignOut() {
+	phone := t.login("user-id")
+	laptop := t.login("user-id")
+
+	res := &dto.SignOutResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "SignOut", &dto.SignOutRequest{AccessToken: phone.AccessToken}, res))
+	t.True(res.Success)
+
+	_, err := t.tokenSvc.ValidateToken(t.ctx, phone.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = t.tokenSvc.ValidateToken(t.ctx, laptop.AccessToken, "")
+	t.NoError(err)
+
+	// the token is no longer valid, so it cannot sign out again
+	err = t.invoke(t.ctx, "SignOut", &dto.SignOutRequest{AccessToken: phone.AccessToken}, res)
+	t.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func (t *AuthServiceTest) TestSignOutAllDevices() {
+	phone := t.login("user-id")
+	laptop := t.login("user-id")
+	other := t.login("other-id")
+
+	res := &dto.SignOutAllDevicesResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "SignOutAllDevices", &dto.SignOutAllDevicesRequest{AccessToken: phone.AccessToken}, res))
+	t.True(res.Success)
+
+	for _, credentials := range []*dto.Credentials{phone, laptop} {
+		_, err := t.tokenSvc.RefreshToken(t.ctx, credentials.RefreshToken)
+		t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	}
+	_, err := t.tokenSvc.ValidateToken(t.ctx, other.AccessToken, "")
+	t.NoError(err)
+}
+
+func (t *AuthServiceTest) TestSignOutInvalidToken() {
+	err := t.invoke(t.ctx, "SignOut", &dto.SignOutRequest{AccessToken: "invalid"}, &dto.SignOutResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func (t *AuthServiceTest) TestIntrospect() {
+	credentials := t.login("user-id")
+
+	res := &dto.IntrospectResponse{}
+	t.Require().NoError(t.invoke(t.asService("checkin"), "Introspect", &dto.IntrospectRequest{Token: credentials.AccessToken}, res))
+	t.True(res.Active)
+	t.Equal("user-id", res.Sub)
+	t.Equal(dto.AccessTokenType, res.TokenType)
+
+	res = &dto.IntrospectResponse{}
+	t.Require().NoError(t.invoke(t.asService("checkin"), "Introspect", &dto.IntrospectRequest{Token: credentials.RefreshToken, TokenTypeHint: dto.RefreshTokenType}, res))
+	t.True(res.Active)
+	t.Equal(dto.RefreshTokenType, res.TokenType)
+
+	res = &dto.IntrospectResponse{}
+	t.Require().NoError(t.invoke(t.asService("checkin"), "Introspect", &dto.IntrospectRequest{Token: "invalid"}, res))
+	t.False(res.Active)
+}
+
+func (t *AuthServiceTest) TestIntrospectRequiresServiceToken() {
+	credentials := t.login("user-id")
+	req := &dto.IntrospectRequest{Token: credentials.AccessToken}
+
+	err := t.invoke(t.ctx, "Introspect", req, &dto.IntrospectResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+
+	// a user's own access token is not a service token
+	ctx := metadata.AppendToOutgoingContext(t.ctx, "authorization", "Bearer "+credentials.AccessToken)
+	err = t.invoke(ctx, "Introspect", req, &dto.IntrospectResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func (t *AuthServiceTest) scopes(accessToken string) []string {
+	credentials, err := t.tokenSvc.ValidateToken(t.ctx, accessToken, "")
+	t.Require().NoError(err)
+
+	return credentials.Scopes
+}
+
+func (t *AuthServiceTest) TestGrantPermission() {
+	admin := t.login(adminId)
+
+	res := &dto.PermissionResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "GrantPermission", &dto.PermissionRequest{AccessToken: admin.AccessToken, UserId: staffId, Permission: "stamp:award"}, res))
+	t.True(res.Success)
+	t.Require().NoError(t.invoke(t.ctx, "GrantPermission", &dto.PermissionRequest{AccessToken: admin.AccessToken, Role: string(constant.STAFF), Permission: "checkin:write"}, res))
+
+	list := &dto.ListPermissionsResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "ListPermissions", &dto.ListPermissionsRequest{AccessToken: admin.AccessToken, UserId: staffId}, list))
+	t.Equal([]string{"stamp:award"}, list.Permissions)
+	t.Require().NoError(t.invoke(t.ctx, "ListPermissions", &dto.ListPermissionsRequest{AccessToken: admin.AccessToken, Role: string(constant.STAFF)}, list))
+	t.Equal([]string{"checkin:write"}, list.Permissions)
+
+	staff := t.loginAs(staffId, constant.STAFF)
+	t.Equal([]string{"checkin:write", "stamp:award"}, t.scopes(staff.AccessToken))
+}
+
+func (t *AuthServiceTest) TestRevokeRolePermission() {
+	t.rolePermissions[constant.STAFF] = []string{"checkin:write", "stamp:award"}
+	admin := t.login(adminId)
+	staff := t.loginAs(staffId, constant.STAFF)
+	user := t.login("user-id")
+
+	res := &dto.PermissionResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "RevokePermission", &dto.PermissionRequest{AccessToken: admin.AccessToken, Role: string(constant.STAFF), Permission: "checkin:write"}, res))
+	t.True(res.Success)
+
+	// the staff's token still carries checkin:write, so it is rejected until refreshed
+	_, err := t.tokenSvc.ValidateToken(t.ctx, staff.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = t.tokenSvc.ValidateToken(t.ctx, user.AccessToken, "")
+	t.NoError(err)
+
+	time.Sleep(2 * time.Millisecond)
+	refreshed, err := t.tokenSvc.RefreshToken(t.ctx, staff.RefreshToken)
+	t.Require().NoError(err)
+	t.Equal([]string{"stamp:award"}, t.scopes(refreshed.AccessToken))
+}
+
+func (t *AuthServiceTest) TestRevokeUserPermission() {
+	t.userPermissions[staffId] = []string{"stamp:award"}
+	admin := t.login(adminId)
+	staff := t.loginAs(staffId, constant.STAFF)
+
+	res := &dto.PermissionResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "RevokePermission", &dto.PermissionRequest{AccessToken: admin.AccessToken, UserId: staffId, Permission: "stamp:award"}, res))
+
+	_, err := t.tokenSvc.ValidateToken(t.ctx, staff.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = t.tokenSvc.RefreshToken(t.ctx, staff.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	t.Empty(t.userPermissions[staffId])
+}
+
+func (t *AuthServiceTest) TestPermissionRequiresManage() {
+	user := t.login("user-id")
+
+	err := t.invoke(t.ctx, "GrantPermission", &dto.PermissionRequest{AccessToken: user.AccessToken, UserId: staffId, Permission: "stamp:award"}, &dto.PermissionResponse{})
+	t.Equal(codes.PermissionDenied, status.Code(err))
+	err = t.invoke(t.ctx, "ListPermissions", &dto.ListPermissionsRequest{AccessToken: user.AccessToken, UserId: staffId}, &dto.ListPermissionsResponse{})
+	t.Equal(codes.PermissionDenied, status.Code(err))
+	t.Empty(t.userPermissions)
+}
+
+func (t *AuthServiceTest) TestPermissionInvalidArgument() {
+	admin := t.login(adminId)
+
+	tests := []*dto.PermissionRequest{
+		{AccessToken: admin.AccessToken, UserId: "not-a-uuid", Permission: "stamp:award"},
+		{AccessToken: admin.AccessToken, UserId: staffId, Permission: "Stamp Award"},
+		{AccessToken: admin.AccessToken, UserId: staffId, Role: string(constant.STAFF), Permission: "stamp:award"},
+		{AccessToken: admin.AccessToken, Permission: "stamp:award"},
+	}
+	for _, req := range tests {
+		err := t.invoke(t.ctx, "GrantPermission", req, &dto.PermissionResponse{})
+		t.Equal(codes.InvalidArgument, status.Code(err), req)
+	}
+
+	err := t.invoke(t.ctx, "RevokePermission", &dto.PermissionRequest{AccessToken: admin.AccessToken, UserId: "not-a-uuid", Permission: "stamp:award"}, &dto.PermissionResponse{})
+	t.Equal(codes.InvalidArgument, status.Code(err))
+}
+
+func (t *AuthServiceTest) TestClientCredentials() {
+	hashedSecret, err := auth.NewBcryptUtils().GenerateHashedPassword("checkin-secret")
+	t.Require().NoError(err)
+	t.authConf.ServiceClients = map[string]string{"checkin": hashedSecret}
+
+	res := &dto.ClientCredentialsResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "ClientCredentials", &dto.ClientCredentialsRequest{ClientId: "checkin", ClientSecret: "checkin-secret"}, res))
+	t.Equal(300, res.ExpiresIn)
+
+	serviceCredentials, err := t.tokenSvc.ValidateServiceToken(t.ctx, res.AccessToken)
+	t.Require().NoError(err)
+	t.Equal("checkin", serviceCredentials.ClientId)
+
+	for _, req := range []*dto.ClientCredentialsRequest{
+		{ClientId: "checkin", ClientSecret: "wrong-secret"},
+		{ClientId: "unknown", ClientSecret: "checkin-secret"},
+	} {
+		err = t.invoke(t.ctx, "ClientCredentials", req, &dto.ClientCredentialsResponse{})
+		t.Equal(codes.Unauthenticated, status.Code(err), req.ClientId)
+	}
+}
+
+func (t *AuthServiceTest) expectFindOne(userId string, role constant.Role) {
+	t.userSvc.EXPECT().FindOne(gomock.Any(), &userProto.FindOneUserRequest{Id: userId}).Return(&userProto.FindOneUserResponse{
+		User: &userProto.User{Id: userId, Role: string(role)},
+	}, nil)
+}
+
+func (t *AuthServiceTest) TestImpersonate() {
+	t.userPermissions[staffId] = []string{permission.ImpersonateUsers}
+	staff := t.loginAs(staffId, constant.STAFF)
+	user := t.login("user-id")
+	t.expectFindOne("user-id", constant.USER)
+
+	res := &dto.ImpersonateResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "Impersonate", &dto.ImpersonateRequest{AccessToken: staff.AccessToken, UserId: "user-id", Reason: "ticket 42"}, res))
+	t.Equal([]string{audit.ImpersonationStarted + " " + staffId + " user-id ticket 42"}, t.audit.records)
+
+	credentials, err := t.tokenSvc.ValidateToken(t.ctx, res.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", credentials.UserID)
+	t.Equal(staffId, credentials.ActorID)
+
+	// the impersonation token cannot end the user's sessions
+	err = t.invoke(t.ctx, "SignOut", &dto.SignOutRequest{AccessToken: res.AccessToken}, &dto.SignOutResponse{})
+	t.Equal(codes.PermissionDenied, status.Code(err))
+	err = t.invoke(t.ctx, "SignOutAllDevices", &dto.SignOutAllDevicesRequest{AccessToken: res.AccessToken}, &dto.SignOutAllDevicesResponse{})
+	t.Equal(codes.PermissionDenied, status.Code(err))
+
+	_, err = t.tokenSvc.RefreshToken(t.ctx, user.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *AuthServiceTest) TestImpersonatePrivilegedUser() {
+	t.userPermissions[staffId] = []string{permission.ImpersonateUsers}
+	t.userPermissions["other-staff-id"] = []string{permission.ImpersonateUsers}
+	staff := t.loginAs(staffId, constant.STAFF)
+
+	for _, target := range []string{adminId, "other-staff-id"} {
+		t.expectFindOne(target, constant.STAFF)
+
+		err := t.invoke(t.ctx, "Impersonate", &dto.ImpersonateRequest{AccessToken: staff.AccessToken, UserId: target}, &dto.ImpersonateResponse{})
+		t.Equal(codes.PermissionDenied, status.Code(err), target)
+	}
+	t.Empty(t.audit.records)
+}
+
+func (t *AuthServiceTest) TestImpersonateRequiresPermission() {
+	user := t.login("user-id")
+
+	err := t.invoke(t.ctx, "Impersonate", &dto.ImpersonateRequest{AccessToken: user.AccessToken, UserId: "other-id"}, &dto.ImpersonateResponse{})
+	t.Equal(codes.PermissionDenied, status.Code(err))
+	t.Empty(t.audit.records)
+}
+
+func (t *AuthServiceTest) TestQrToken() {
+	user := t.login("user-id")
+
+	created := &dto.CreateQrTokenResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "CreateQrToken", &dto.CreateQrTokenRequest{AccessToken: user.AccessToken, Purpose: "checkin"}, created))
+	t.Equal(60, created.ExpiresIn)
+
+	redeemed := &dto.RedeemQrTokenResponse{}
+	t.Require().NoError(t.invoke(t.asService("checkin"), "RedeemQrToken", &dto.RedeemQrTokenRequest{Token: created.Token, Purpose: "checkin"}, redeemed))
+	t.Equal("user-id", redeemed.UserId)
+
+	err := t.invoke(t.asService("checkin"), "RedeemQrToken", &dto.RedeemQrTokenRequest{Token: created.Token, Purpose: "checkin"}, redeemed)
+	t.Equal(codes.FailedPrecondition, status.Code(err))
+}
+
+func (t *AuthServiceTest) TestRedeemQrTokenRequiresServiceToken() {
+	user := t.login("user-id")
+	created := &dto.CreateQrTokenResponse{}
+	t.Require().NoError(t.invoke(t.ctx, "CreateQrToken", &dto.CreateQrTokenRequest{AccessToken: user.AccessToken, Purpose: "checkin"}, created))
+	req := &dto.RedeemQrTokenRequest{Token: created.Token, Purpose: "checkin"}
+
+	err := t.invoke(t.ctx, "RedeemQrToken", req, &dto.RedeemQrTokenResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+
+	// the user cannot redeem their own qr token
+	ctx := metadata.AppendToOutgoingContext(t.ctx, "authorization", "Bearer "+user.AccessToken)
+	err = t.invoke(ctx, "RedeemQrToken", req, &dto.RedeemQrTokenResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+
+	// so it is still there for the scanning service
+	t.NoError(t.invoke(t.asService("checkin"), "RedeemQrToken", req, &dto.RedeemQrTokenResponse{}))
+}
+
+func (t *AuthServiceTest) TestCreateQrTokenInvalidToken() {
+	err := t.invoke(t.ctx, "CreateQrToken", &dto.CreateQrTokenRequest{AccessToken: "invalid", Purpose: "checkin"}, &dto.CreateQrTokenResponse{})
+	t.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+// reason returns the ErrorInfo reason of a status error.
+func (t *AuthServiceTest) reason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+
+	return ""
+}
+
+// startGoogleLogin starts a login from the browser holding binding and returns its state.
+func (t *AuthServiceTest) startGoogleLogin(binding string) string {
+	ctx := metadata.NewIncomingContext(t.ctx, metadata.Pairs("x-oauth-binding", binding))
+	res, err := t.svc.GetGoogleLoginUrl(ctx, &authProto.GetGoogleLoginUrlRequest{})
+	t.Require().NoError(err)
+
+	URL, err := url.Parse(res.Url)
+	t.Require().NoError(err)
+	t.Equal("S256", URL.Query().Get("code_challenge_method"))
+
+	return URL.Query().Get("state")
+}
+
+func (t *AuthServiceTest) verifyGoogleLogin(state string, binding string) (*authProto.VerifyGoogleLoginResponse, error) {
+	ctx := metadata.NewIncomingContext(t.ctx, metadata.Pairs("x-oauth-state", state, "x-oauth-binding", binding))
+	return t.svc.VerifyGoogleLogin(ctx, &authProto.VerifyGoogleLoginRequest{Code: "code"})
+}
+
+func (t *AuthServiceTest) expectFindByEmail() {
+	t.userSvc.EXPECT().FindByEmail(gomock.Any(), &userProto.FindByEmailRequest{Email: t.google.email}).
+		Return(&userProto.FindByEmailResponse{User: &userProto.User{Id: "user-id", Role: string(constant.USER)}}, nil)
+}
+
+func (t *AuthServiceTest) TestGoogleLogin() {
+	state := t.startGoogleLogin("binding")
+	t.NotEmpty(state)
+	t.expectFindByEmail()
+
+	res, err := t.verifyGoogleLogin(state, "binding")
+	t.Require().NoError(err)
+	t.Equal("user-id", res.UserId)
+	t.Len(t.google.codeVerifiers, 1)
+
+	_, err = t.tokenSvc.ValidateToken(t.ctx, res.Credential.AccessToken, "")
+	t.NoError(err)
+}
+
+func (t *AuthServiceTest) TestGoogleLoginMissingState() {
+	t.startGoogleLogin("binding")
+
+	_, err := t.verifyGoogleLogin("", "binding")
+	t.Equal(codes.InvalidArgument, status.Code(err))
+	t.Equal(apperror.InvalidState.Reason, t.reason(err))
+	t.Empty(t.google.codeVerifiers)
+}
+
+func (t *AuthServiceTest) TestGoogleLoginReplayedState() {
+	state := t.startGoogleLogin("binding")
+	t.expectFindByEmail()
+
+	_, err := t.verifyGoogleLogin(state, "binding")
+	t.Require().NoError(err)
+
+	_, err = t.verifyGoogleLogin(state, "binding")
+	t.Equal(apperror.InvalidState.Reason, t.reason(err))
+	t.Len(t.google.codeVerifiers, 1)
+}
+
+func (t *AuthServiceTest) TestGoogleLoginMismatchedState() {
+	t.startGoogleLogin("binding")
+
+	_, err := t.verifyGoogleLogin("forged", "binding")
+	t.Equal(apperror.InvalidState.Reason, t.reason(err))
+	t.Empty(t.google.codeVerifiers)
+}
+
+func (t *AuthServiceTest) TestGoogleLoginFromAnotherBrowser() {
+	// the attacker starts a login and gets the victim's browser to finish it
+	state := t.startGoogleLogin("attacker-binding")
+
+	_, err := t.verifyGoogleLogin(state, "victim-binding")
+	t.Equal(apperror.InvalidState.Reason, t.reason(err))
+	t.Empty(t.google.codeVerifiers)
+}
+
+func (t *AuthServiceTest) TestGoogleLoginMissingBinding() {
+	_, err := t.svc.GetGoogleLoginUrl(t.ctx, &authProto.GetGoogleLoginUrlRequest{})
+	t.Equal(codes.InvalidArgument, status.Code(err))
+	t.Equal(apperror.MissingOauthBinding.Reason, t.reason(err))
+
+	state := t.startGoogleLogin("binding")
+	_, err = t.verifyGoogleLogin(state, "")
+	t.Equal(apperror.MissingOauthBinding.Reason, t.reason(err))
+	t.Empty(t.google.codeVerifiers)
+}
+
+// ecKeyStore returns a key store with a single EC key, whose public half is published.
+func (t *AuthServiceTest) ecKeyStore() jwt.KeyStore {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	t.Require().NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	t.Require().NoError(err)
+
+	conf := t.jwtConf
+	conf.KeysDir = t.T().TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	t.Require().NoError(os.WriteFile(filepath.Join(conf.KeysDir, "key.pem"), data, 0o600))
+
+	keys, err := jwt.NewKeyStore(conf)
+	t.Require().NoError(err)
+
+	return keys
+}
+
+func (t *AuthServiceTest) TestGetJwks() {
+	keys := t.ecKeyStore()
+	t.svc = t.newService(keys)
+
+	rec := httptest.NewRecorder()
+	jwt.NewJwksHandler(keys, t.jwtConf.JwksMaxAge, t.logger).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, jwt.JwksPath, nil))
+	t.Require().Equal(http.StatusOK, rec.Code)
+	expected := &dto.JWKS{}
+	t.Require().NoError(json.Unmarshal(rec.Body.Bytes(), expected))
+
+	res := &dto.JWKS{}
+	var header metadata.MD
+	err := t.invoke(t.ctx, "GetJwks", &dto.GetJwksRequest{}, res, grpc.Header(&header))
+
+	t.NoError(err)
+	t.Len(res.Keys, 1)
+	t.Equal(expected, res)
+	t.Equal([]string{rec.Header().Get("Cache-Control")}, header.Get("cache-control"))
+}
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"strings"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/auth"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"google.golang.org/grpc/metadata"
+)
+
+func (t *AuthServiceTest) TestClientFromContext() {
+	tests := []struct {
+		name     string
+		md       metadata.MD
+		expected *dto.ClientInfo
+	}{
+		{
+			name: "client and audiences",
+			md:   metadata.Pairs("x-client-id", "gateway", "x-audience", " gateway, ,checkin ", "x-device-name", "phone", "user-agent", "Mozilla/5.0"),
+			expected: &dto.ClientInfo{
+				Device:   "phone",
+				ClientId: "gateway",
+				Audience: []string{"gateway", "checkin"},
+			},
+		},
+		{
+			name:     "no audience requested",
+			md:       metadata.Pairs("x-client-id", "gateway", "user-agent", "Mozilla/5.0"),
+			expected: &dto.ClientInfo{Device: "Mozilla/5.0", ClientId: "gateway"},
+		},
+		{
+			name:     "device name too long",
+			md:       metadata.Pairs("x-device-name", strings.Repeat("a", 200)),
+			expected: &dto.ClientInfo{Device: strings.Repeat("a", 128)},
+		},
+		{
+			name:     "no metadata",
+			expected: &dto.ClientInfo{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			ctx := t.ctx
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			t.Equal(tt.expected, auth.ClientFromContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is the cause of the CacheUnavailable returned without calling the cache while
+// the circuit breaker is open.
+var ErrCircuitOpen = errors.New("cache circuit breaker is open")
+
+var (
+	circuitOpenGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_cache_circuit_open",
+		Help: "Whether the circuit breaker around the cache is open, failing calls without trying the cache.",
+	})
+	circuitRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_cache_circuit_rejected_total",
+		Help: "Number of cache calls failed by the open circuit breaker.",
+	})
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// circuitHalfOpen lets a single call through to probe whether the cache is back.
+	circuitHalfOpen
+)
+
+type BreakerOptions struct {
+	// Threshold is how many calls in a row have to fail to reach the cache before the circuit
+	// opens. Zero disables the breaker.
+	Threshold int
+	// Cooldown is how long the circuit stays open before a call is let through to probe.
+	Cooldown time.Duration
+	// OnStateChange is called with whether the circuit is now open, e.g. to report the cache
+	// as unhealthy. It must not call the repository.
+	OnStateChange func(open bool)
+}
+
+type circuitBreakerImpl struct {
+	repo          Repository
+	threshold     int
+	cooldown      time.Duration
+	onStateChange func(open bool)
+	log           *zap.Logger
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// generation changes with every transition, so that a call started before one does not
+	// count towards the new state.
+	generation int
+}
+
+// NewCircuitBreaker fails calls fast with CacheUnavailable once the cache has been
+// unreachable for Threshold calls in a row, instead of having every call wait for its
+// timeout. Only failures to reach the cache count; missing keys and calls given up by the
+// caller do not.
+func NewCircuitBreaker(repo Repository, opts BreakerOptions, log *zap.Logger) Repository {
+	if opts.Threshold <= 0 {
+		return repo
+	}
+
+	return &circuitBreakerImpl{
+		repo:          repo,
+		threshold:     opts.Threshold,
+		cooldown:      opts.Cooldown,
+		onStateChange: opts.OnStateChange,
+		log:           log,
+	}
+}
+
+func (b *circuitBreakerImpl) SetValue(ctx context.Context, key string, value interface{}, ttl int) error {
+	return b.call(ctx, func() error { return b.repo.SetValue(ctx, key, value, ttl) })
+}
+
+func (b *circuitBreakerImpl) GetValue(ctx context.Context, key string, value interface{}) error {
+	return b.call(ctx, func() error { return b.repo.GetValue(ctx, key, value) })
+}
+
+func (b *circuitBreakerImpl) GetValues(ctx context.Context, keys []string, values []interface{}) ([]bool, error) {
+	var found []bool
+	err := b.call(ctx, func() (err error) {
+		found, err = b.repo.GetValues(ctx, keys, values)
+		return err
+	})
+
+	return found, err
+}
+
+func (b *circuitBreakerImpl) GetDelValue(ctx context.Context, key string, value interface{}) error {
+	return b.call(ctx, func() error { return b.repo.GetDelValue(ctx, key, value) })
+}
+
+func (b *circuitBreakerImpl) DeleteValue(ctx context.Context, key string) error {
+	return b.call(ctx, func() error { return b.repo.DeleteValue(ctx, key) })
+}
+
+func (b *circuitBreakerImpl) DeleteValues(ctx context.Context, keys ...string) error {
+	return b.call(ctx, func() error { return b.repo.DeleteValues(ctx, keys...) })
+}
+
+func (b *circuitBreakerImpl) SetValueNX(ctx context.Context, key string, value interface{}, ttl int) (bool, error) {
+	var ok bool
+	err := b.call(ctx, func() (err error) {
+		ok, err = b.repo.SetValueNX(ctx, key, value, ttl)
+		return err
+	})
+
+	return ok, err
+}
+
+func (b *circuitBreakerImpl) SetValues(ctx context.Context, entries ...Entry) error {
+	return b.call(ctx, func() error { return b.repo.SetValues(ctx, entries...) })
+}
+
+func (b *circuitBreakerImpl) SetValuesPipelined(ctx context.Context, entries ...Entry) error {
+	return b.call(ctx, func() error { return b.repo.SetValuesPipelined(ctx, entries...) })
+}
+
+func (b *circuitBreakerImpl) SetField(ctx context.Context, key string, field string, value interface{}) error {
+	return b.call(ctx, func() error { return b.repo.SetField(ctx, key, field, value) })
+}
+
+func (b *circuitBreakerImpl) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	var fields map[string]string
+	err := b.call(ctx, func() (err error) {
+		fields, err = b.repo.GetFields(ctx, key)
+		return err
+	})
+
+	return fields, err
+}
+
+func (b *circuitBreakerImpl) DeleteFields(ctx context.Context, key string, fields ...string) error {
+	return b.call(ctx, func() error { return b.repo.DeleteFields(ctx, key, fields...) })
+}
+
+func (b *circuitBreakerImpl) Expire(ctx context.Context, key string, ttl int) error {
+	return b.call(ctx, func() error { return b.repo.Expire(ctx, key, ttl) })
+}
+
+func (b *circuitBreakerImpl) call(ctx context.Context, fn func() error) error {
+	generation, err := b.acquire()
+	if err != nil {
+		circuitRejected.Inc()
+		return err
+	}
+
+	err = fn()
+	b.release(ctx, generation, err)
+
+	return err
+}
+
+// acquire reports whether a call may go through, and moves an open circuit whose cooldown has
+// passed to half-open for the call to probe with.
+func (b *circuitBreakerImpl) acquire() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return 0, apperror.CacheUnavailable.Wrap(ErrCircuitOpen)
+		}
+		b.transition(circuitHalfOpen)
+	case circuitHalfOpen:
+		// a probe is already in flight
+		return 0, apperror.CacheUnavailable.Wrap(ErrCircuitOpen)
+	}
+
+	return b.generation, nil
+}
+
+func (b *circuitBreakerImpl) release(ctx context.Context, generation int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	failed := errors.Is(err, apperror.CacheUnavailable) && ctx.Err() == nil
+
+	switch b.state {
+	case circuitClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.log.Warn("cache unreachable, opening circuit breaker", zap.Int("failures", b.failures), zap.Duration("cooldown", b.cooldown), zap.Error(err))
+			b.openedAt = time.Now()
+			b.transition(circuitOpen)
+		}
+	case circuitHalfOpen:
+		switch {
+		case failed:
+			b.log.Warn("cache still unreachable, keeping circuit breaker open", zap.Error(err))
+			b.openedAt = time.Now()
+			b.transition(circuitOpen)
+		case ctx.Err() != nil:
+			// the probe was given up by its caller, so the next call probes instead
+			b.transition(circuitOpen)
+		default:
+			b.log.Info("cache reachable again, closing circuit breaker")
+			b.failures = 0
+			b.transition(circuitClosed)
+		}
+	}
+}
+
+// transition moves the breaker to state. The caller holds mu.
+func (b *circuitBreakerImpl) transition(state circuitState) {
+	wasOpen := b.state != circuitClosed
+	b.state = state
+	b.generation++
+
+	open := state != circuitClosed
+	if open == wasOpen {
+		return
+	}
+
+	if open {
+		circuitOpenGauge.Set(1)
+	} else {
+		circuitOpenGauge.Set(0)
+	}
+	if b.onStateChange != nil {
+		b.onStateChange(open)
+	}
+}
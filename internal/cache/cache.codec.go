@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// envelopeMagic starts every value written with an envelope. JSON never starts with it, so
+// values written before the envelope are still read, as schema version 0.
+const envelopeMagic byte = 0xfe
+
+const (
+	encodingJson   byte = 'j'
+	encodingBinary byte = 'b'
+)
+
+// Options are shared by every Repository implementation.
+type Options struct {
+	// KeyPrefix is put in front of every key, so environments and apps sharing one redis do
+	// not collide. Changing it orphans every stored value.
+	KeyPrefix string
+	// Binary stores values that implement encoding.BinaryMarshaler, such as sessions, in their
+	// compact binary form instead of JSON. Either form is read whatever the setting.
+	Binary bool
+	// Timeout bounds every redis call, so a redis that stops answering fails the call instead
+	// of holding it for the caller's whole deadline. It defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Versioned values are stored with their schema version, which is bumped whenever a change to
+// the type means values written by an older release have to be upgraded when read.
+type Versioned interface {
+	SchemaVersion() int
+}
+
+// Upgradable values are called after being decoded from an older schema version, which is 0
+// for values written before schema versions were recorded.
+type Upgradable interface {
+	UpgradeFrom(version int) error
+}
+
+// valueCodec turns values into what is stored: an envelope holding the encoding, the schema
+// version and the JSON or binary encoded value. Hash fields stay plain JSON.
+type valueCodec struct {
+	prefix string
+	binary bool
+}
+
+func newValueCodec(opts Options) valueCodec {
+	return valueCodec{prefix: opts.KeyPrefix, binary: opts.Binary}
+}
+
+func (c valueCodec) key(key string) string {
+	return c.prefix + key
+}
+
+func (c valueCodec) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.key(key)
+	}
+
+	return prefixed
+}
+
+func (c valueCodec) encode(value interface{}) ([]byte, error) {
+	version := 0
+	if versioned, ok := value.(Versioned); ok {
+		version = versioned.SchemaVersion()
+	}
+
+	var payload []byte
+	var err error
+	encoded := encodingJson
+	if marshaler, ok := value.(encoding.BinaryMarshaler); ok && c.binary {
+		encoded = encodingBinary
+		payload, err = marshaler.MarshalBinary()
+	} else {
+		payload, err = json.Marshal(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := binary.AppendUvarint([]byte{envelopeMagic, encoded}, uint64(version))
+	return append(data, payload...), nil
+}
+
+func (c valueCodec) decode(data []byte, value interface{}) error {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		if err := json.Unmarshal(data, value); err != nil {
+			return err
+		}
+		return upgrade(value, 0)
+	}
+
+	if len(data) < 3 {
+		return errors.New("value envelope is truncated")
+	}
+
+	version, n := binary.Uvarint(data[2:])
+	if n <= 0 {
+		return errors.New("value envelope has an invalid schema version")
+	}
+	payload := data[2+n:]
+
+	switch data[1] {
+	case encodingJson:
+		if err := json.Unmarshal(payload, value); err != nil {
+			return err
+		}
+	case encodingBinary:
+		unmarshaler, ok := value.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("%T cannot be decoded from its binary form", value)
+		}
+		if err := unmarshaler.UnmarshalBinary(payload); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown value encoding %q", data[1])
+	}
+
+	return upgrade(value, int(version))
+}
+
+// upgrade runs the value's upgrade hook when it was stored with an older schema version. A
+// value written by a newer release, e.g. during a rolling deploy, is used as decoded.
+func upgrade(value interface{}, version int) error {
+	versioned, ok := value.(Versioned)
+	if !ok || version >= versioned.SchemaVersion() {
+		return nil
+	}
+
+	if upgradable, ok := value.(Upgradable); ok {
+		return upgradable.UpgradeFrom(version)
+	}
+
+	return nil
+}
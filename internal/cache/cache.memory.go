@@ -0,0 +1,360 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sweepInterval is how many writes the memory repository takes between scans for expired keys.
+// Expired keys are also dropped whenever they are read.
+const sweepInterval = 1024
+
+// errWrongType is the reply redis gives for a string command on a hash or the other way round.
+var errWrongType error = wrongTypeError{}
+
+type wrongTypeError struct{}
+
+func (wrongTypeError) Error() string {
+	return "WRONGTYPE Operation against a key holding the wrong kind of value"
+}
+
+// RedisError makes it a redis.Error, like the reply it stands in for.
+func (wrongTypeError) RedisError() {}
+
+type memoryEntry struct {
+	value     []byte
+	fields    map[string]string
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+type memoryRepositoryImpl struct {
+	mu      sync.Mutex
+	codec   valueCodec
+	entries map[string]*memoryEntry
+	writes  int
+}
+
+// NewMemoryRepository keeps values in the process, for development and tests without redis.
+// Values are encoded and missing keys are reported as redis.Nil exactly as with NewRepository,
+// but nothing is shared between replicas or survives a restart.
+func NewMemoryRepository(opts Options) Repository {
+	return &memoryRepositoryImpl{codec: newValueCodec(opts), entries: map[string]*memoryEntry{}}
+}
+
+func (r *memoryRepositoryImpl) SetValue(ctx context.Context, key string, value interface{}, ttl int) error {
+	return r.SetValues(ctx, Entry{Key: key, Value: value, TTL: ttl})
+}
+
+func (r *memoryRepositoryImpl) GetValue(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	entry, err := r.get(r.codec.key(key))
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return r.codec.decode(entry.value, value)
+}
+
+func (r *memoryRepositoryImpl) GetValues(ctx context.Context, keys []string, values []interface{}) ([]bool, error) {
+	if len(keys) != len(values) {
+		return nil, errors.New("keys and values differ in length")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(ctx, err)
+	}
+
+	// like the pipelined GETs, a key holding a hash fails the whole read
+	raw := make([][]byte, len(keys))
+	r.mu.Lock()
+	for i, key := range keys {
+		entry, err := r.get(r.codec.key(key))
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		raw[i] = entry.value
+	}
+	r.mu.Unlock()
+
+	found := make([]bool, len(keys))
+	for i, v := range raw {
+		if v == nil {
+			continue
+		}
+
+		if err := r.codec.decode(v, values[i]); err != nil {
+			return nil, err
+		}
+		found[i] = true
+	}
+
+	return found, nil
+}
+
+func (r *memoryRepositoryImpl) GetDelValue(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	entry, err := r.get(r.codec.key(key))
+	if err == nil {
+		delete(r.entries, r.codec.key(key))
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return r.codec.decode(entry.value, value)
+}
+
+func (r *memoryRepositoryImpl) DeleteValue(ctx context.Context, key string) error {
+	return r.DeleteValues(ctx, key)
+}
+
+func (r *memoryRepositoryImpl) DeleteValues(ctx context.Context, keys ...string) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range r.codec.keys(keys) {
+		delete(r.entries, key)
+	}
+
+	return nil
+}
+
+func (r *memoryRepositoryImpl) SetValueNX(ctx context.Context, key string, value interface{}, ttl int) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(ctx, err)
+	}
+
+	v, err := r.codec.encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.entries[r.codec.key(key)]; ok && !entry.expired(time.Now()) {
+		return false, nil
+	}
+
+	r.set(r.codec.key(key), &memoryEntry{value: v, expiresAt: expiresAt(ttl)})
+	return true, nil
+}
+
+func (r *memoryRepositoryImpl) SetValues(ctx context.Context, entries ...Entry) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		v, err := r.codec.encode(entry.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, entry := range entries {
+		r.set(r.codec.key(entry.Key), &memoryEntry{value: values[i], expiresAt: expiresAt(entry.TTL)})
+	}
+
+	return nil
+}
+
+// SetValuesPipelined is SetValues, as there is no round trip to save.
+func (r *memoryRepositoryImpl) SetValuesPipelined(ctx context.Context, entries ...Entry) error {
+	return r.SetValues(ctx, entries...)
+}
+
+func (r *memoryRepositoryImpl) SetField(ctx context.Context, key string, field string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.getHash(r.codec.key(key))
+	if errors.Is(err, redis.Nil) {
+		entry = &memoryEntry{fields: map[string]string{}}
+		r.set(r.codec.key(key), entry)
+	} else if err != nil {
+		return err
+	}
+
+	entry.fields[field] = string(v)
+	return nil
+}
+
+func (r *memoryRepositoryImpl) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// like HGETALL, a missing key reads as an empty hash
+	fields := map[string]string{}
+	entry, err := r.getHash(r.codec.key(key))
+	if errors.Is(err, redis.Nil) {
+		return fields, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for field, value := range entry.fields {
+		fields[field] = value
+	}
+
+	return fields, nil
+}
+
+func (r *memoryRepositoryImpl) DeleteFields(ctx context.Context, key string, fields ...string) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.getHash(r.codec.key(key))
+	if errors.Is(err, redis.Nil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		delete(entry.fields, field)
+	}
+	// redis deletes a hash with its last field
+	if len(entry.fields) == 0 {
+		delete(r.entries, r.codec.key(key))
+	}
+
+	return nil
+}
+
+func (r *memoryRepositoryImpl) Expire(ctx context.Context, key string, ttl int) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(ctx, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.lookup(r.codec.key(key))
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+
+	// like EXPIRE, a ttl that has already run out deletes the key
+	if ttl <= 0 {
+		delete(r.entries, r.codec.key(key))
+		return nil
+	}
+	entry.expiresAt = expiresAt(ttl)
+
+	return nil
+}
+
+// get returns the live string value at key. The caller holds mu.
+func (r *memoryRepositoryImpl) get(key string) (*memoryEntry, error) {
+	entry, err := r.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.fields != nil {
+		return nil, errWrongType
+	}
+
+	return entry, nil
+}
+
+// getHash returns the live hash at key. The caller holds mu.
+func (r *memoryRepositoryImpl) getHash(key string) (*memoryEntry, error) {
+	entry, err := r.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry.fields == nil {
+		return nil, errWrongType
+	}
+
+	return entry, nil
+}
+
+func (r *memoryRepositoryImpl) lookup(key string) (*memoryEntry, error) {
+	entry, ok := r.entries[key]
+	if !ok {
+		return nil, redis.Nil
+	}
+	if entry.expired(time.Now()) {
+		delete(r.entries, key)
+		return nil, redis.Nil
+	}
+
+	return entry, nil
+}
+
+// set stores entry at key and every sweepInterval writes drops the keys that have expired. The
+// caller holds mu.
+func (r *memoryRepositoryImpl) set(key string, entry *memoryEntry) {
+	r.entries[key] = entry
+
+	r.writes++
+	if r.writes < sweepInterval {
+		return
+	}
+	r.writes = 0
+
+	now := time.Now()
+	for k, e := range r.entries {
+		if e.expired(now) {
+			delete(r.entries, k)
+		}
+	}
+}
+
+// expiresAt follows SET EX: a ttl of zero stores the value without expiry.
+func expiresAt(ttl int) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
@@ -3,52 +3,287 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
 	"github.com/redis/go-redis/v9"
 )
 
+// defaultTimeout bounds every call unless Options.Timeout is set. A sooner deadline of the
+// caller still applies.
+const defaultTimeout = 5 * time.Second
+
+// errTimedOut is the cause of a call given up on after the configured timeout, as opposed to
+// one whose caller cancelled it or ran out of time.
+var errTimedOut = errors.New("cache call timed out")
+
+// Entry is one value written by SetValues or SetValuesPipelined.
+type Entry struct {
+	Key   string
+	Value interface{}
+	TTL   int
+}
+
+// Repository stores values in a versioned envelope, see Options. Every method takes the
+// caller's context, so gRPC deadlines and cancellations reach the cache, and are reported as
+// the context error rather than as CacheUnavailable. A missing key is reported as redis.Nil.
 type Repository interface {
-	SetValue(key string, value interface{}, ttl int) error
-	GetValue(key string, value interface{}) error
-	DeleteValue(key string) error
+	SetValue(ctx context.Context, key string, value interface{}, ttl int) error
+	GetValue(ctx context.Context, key string, value interface{}) error
+	// GetValues reads every key in one round trip and decodes the value of keys[i] into
+	// values[i]. The result reports which keys were found; missing keys are not an error.
+	GetValues(ctx context.Context, keys []string, values []interface{}) ([]bool, error)
+	// GetDelValue reads the value and deletes the key in one atomic step, so of concurrent
+	// callers exactly one gets the value.
+	GetDelValue(ctx context.Context, key string, value interface{}) error
+	DeleteValue(ctx context.Context, key string) error
+	DeleteValues(ctx context.Context, keys ...string) error
+	// SetValueNX stores the value only if key does not exist yet and reports whether it did.
+	SetValueNX(ctx context.Context, key string, value interface{}, ttl int) (bool, error)
+	// SetValues writes every entry in one MULTI/EXEC transaction, so readers see all of them or none.
+	SetValues(ctx context.Context, entries ...Entry) error
+	// SetValuesPipelined writes every entry in one round trip without a transaction, for
+	// writes that do not depend on each other.
+	SetValuesPipelined(ctx context.Context, entries ...Entry) error
+	SetField(ctx context.Context, key string, field string, value interface{}) error
+	GetFields(ctx context.Context, key string) (map[string]string, error)
+	DeleteFields(ctx context.Context, key string, fields ...string) error
+	// Expire sets the ttl of a value or hash that exists. A ttl of zero or less deletes it.
+	Expire(ctx context.Context, key string, ttl int) error
 }
 
 type repositoryImpl struct {
-	client *redis.Client
+	client  redis.UniversalClient
+	codec   valueCodec
+	timeout time.Duration
 }
 
-func NewRepository(client *redis.Client) Repository {
-	return &repositoryImpl{client: client}
+// NewRepository stores values in redis, standalone, behind sentinels or as a cluster. On a
+// cluster the keys of one SetValues call only change together when they share a hash slot.
+func NewRepository(client redis.UniversalClient, opts Options) Repository {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &repositoryImpl{client: client, codec: newValueCodec(opts), timeout: timeout}
 }
 
-func (r *repositoryImpl) SetValue(key string, value interface{}, ttl int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *repositoryImpl) SetValue(ctx context.Context, key string, value interface{}, ttl int) error {
+	ctx, cancel := r.withTimeout(ctx)
 	defer cancel()
 
-	v, err := json.Marshal(value)
+	v, err := r.codec.encode(value)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Set(ctx, key, v, time.Duration(ttl)*time.Second).Err()
+	return wrapError(ctx, r.client.Set(ctx, r.codec.key(key), v, time.Duration(ttl)*time.Second).Err())
+}
+
+func (r *repositoryImpl) GetValue(ctx context.Context, key string, value interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	v, err := r.client.Get(ctx, r.codec.key(key)).Bytes()
+	if err != nil {
+		return wrapError(ctx, err)
+	}
+
+	return r.codec.decode(v, value)
+}
+
+func (r *repositoryImpl) GetValues(ctx context.Context, keys []string, values []interface{}) ([]bool, error) {
+	if len(keys) != len(values) {
+		return nil, errors.New("keys and values differ in length")
+	}
+
+	found := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return found, nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// pipelined GETs rather than MGET, which a cluster refuses for keys in different slots
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, r.codec.key(key))
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, wrapError(ctx, err)
+	}
+
+	for i, cmd := range cmds {
+		v, err := cmd.Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return nil, wrapError(ctx, err)
+		}
+
+		if err := r.codec.decode(v, values[i]); err != nil {
+			return nil, err
+		}
+		found[i] = true
+	}
+
+	return found, nil
+}
+
+func (r *repositoryImpl) GetDelValue(ctx context.Context, key string, value interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	v, err := r.client.GetDel(ctx, r.codec.key(key)).Bytes()
+	if err != nil {
+		return wrapError(ctx, err)
+	}
+
+	return r.codec.decode(v, value)
+}
+
+func (r *repositoryImpl) DeleteValue(ctx context.Context, key string) error {
+	return r.DeleteValues(ctx, key)
+}
+
+func (r *repositoryImpl) DeleteValues(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	// one DEL per key, as a cluster refuses a DEL of keys in different slots
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, r.codec.key(key))
+		}
+		return nil
+	})
+
+	return wrapError(ctx, err)
+}
+
+func (r *repositoryImpl) SetValueNX(ctx context.Context, key string, value interface{}, ttl int) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	v, err := r.codec.encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := r.client.SetNX(ctx, r.codec.key(key), v, time.Duration(ttl)*time.Second).Result()
+	return ok, wrapError(ctx, err)
+}
+
+func (r *repositoryImpl) SetValues(ctx context.Context, entries ...Entry) error {
+	return r.setValues(ctx, r.client.TxPipelined, entries)
+}
+
+func (r *repositoryImpl) SetValuesPipelined(ctx context.Context, entries ...Entry) error {
+	return r.setValues(ctx, r.client.Pipelined, entries)
+}
+
+func (r *repositoryImpl) setValues(ctx context.Context, pipelined func(context.Context, func(redis.Pipeliner) error) ([]redis.Cmder, error), entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	values := make([][]byte, len(entries))
+	for i, entry := range entries {
+		v, err := r.codec.encode(entry.Value)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	_, err := pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			pipe.Set(ctx, r.codec.key(entry.Key), values[i], time.Duration(entry.TTL)*time.Second)
+		}
+		return nil
+	})
+
+	return wrapError(ctx, err)
 }
 
-func (r *repositoryImpl) GetValue(key string, value interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// SetField stores value as JSON under field of the hash at key.
+func (r *repositoryImpl) SetField(ctx context.Context, key string, field string, value interface{}) error {
+	ctx, cancel := r.withTimeout(ctx)
 	defer cancel()
 
-	v, err := r.client.Get(ctx, key).Result()
+	v, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal([]byte(v), value)
+	return wrapError(ctx, r.client.HSet(ctx, r.codec.key(key), field, v).Err())
+}
+
+// GetFields returns every field of the hash at key with its JSON encoded value.
+func (r *repositoryImpl) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	fields, err := r.client.HGetAll(ctx, r.codec.key(key)).Result()
+	return fields, wrapError(ctx, err)
 }
 
-func (r *repositoryImpl) DeleteValue(key string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *repositoryImpl) DeleteFields(ctx context.Context, key string, fields ...string) error {
+	ctx, cancel := r.withTimeout(ctx)
 	defer cancel()
 
-	return r.client.Del(ctx, key).Err()
+	return wrapError(ctx, r.client.HDel(ctx, r.codec.key(key), fields...).Err())
+}
+
+func (r *repositoryImpl) Expire(ctx context.Context, key string, ttl int) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+
+	return wrapError(ctx, r.client.Expire(ctx, r.codec.key(key), time.Duration(ttl)*time.Second).Err())
+}
+
+// withTimeout bounds the call by the configured timeout, or by the caller's deadline when
+// that is sooner.
+func (r *repositoryImpl) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, r.timeout, errTimedOut)
+}
+
+// IsWrongType reports whether err is the WRONGTYPE reply to reading a hash as a value or a
+// value as a hash. Both stores return it as is rather than as CacheUnavailable.
+func IsWrongType(err error) bool {
+	var redisErr redis.Error
+	return errors.As(err, &redisErr) && strings.HasPrefix(redisErr.Error(), "WRONGTYPE")
+}
+
+// wrapError marks failures to reach redis as CacheUnavailable. A missing key is reported as
+// redis.Nil, as before, and a WRONGTYPE reply as is, as redis was reached. A call the caller
+// cancelled or ran out of time for gets the context error instead, as the cache did not fail.
+func wrapError(ctx context.Context, err error) error {
+	if err == nil || errors.Is(err, redis.Nil) || IsWrongType(err) {
+		return err
+	}
+
+	// a socket deadline taken from the context can expire just before the context does
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		<-ctx.Done()
+	}
+	if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errTimedOut) {
+		return ctx.Err()
+	}
+
+	return apperror.CacheUnavailable.Wrap(err)
 }
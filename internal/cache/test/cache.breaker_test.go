@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+// flakyRepository fails GetValue as an unreachable redis would while down is set.
+type flakyRepository struct {
+	cache.Repository
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (r *flakyRepository) GetValue(ctx context.Context, key string, value interface{}) error {
+	r.calls.Add(1)
+	if r.down.Load() {
+		return apperror.CacheUnavailable.Wrap(context.DeadlineExceeded)
+	}
+
+	return r.Repository.GetValue(ctx, key, value)
+}
+
+type CircuitBreakerTest struct {
+	suite.Suite
+	flaky   *flakyRepository
+	repo    cache.Repository
+	changes []bool
+	ctx     context.Context
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	suite.Run(t, new(CircuitBreakerTest))
+}
+
+func (t *CircuitBreakerTest) SetupTest() {
+	t.flaky = &flakyRepository{Repository: cache.NewMemoryRepository(cache.Options{})}
+	t.changes = nil
+	t.repo = cache.NewCircuitBreaker(t.flaky, cache.BreakerOptions{
+		Threshold:     3,
+		Cooldown:      100 * time.Millisecond,
+		OnStateChange: func(open bool) { t.changes = append(t.changes, open) },
+	}, zap.NewNop())
+	t.ctx = context.Background()
+}
+
+func (t *CircuitBreakerTest) TestOpensAfterThreshold() {
+	t.flaky.down.Store(true)
+
+	for i := 0; i < 3; i++ {
+		t.ErrorIs(t.repo.GetValue(t.ctx, "key", new(int)), apperror.CacheUnavailable)
+	}
+	t.Equal([]bool{true}, t.changes)
+
+	err := t.repo.GetValue(t.ctx, "key", new(int))
+	t.ErrorIs(err, apperror.CacheUnavailable)
+	t.ErrorIs(err, cache.ErrCircuitOpen)
+	t.Equal(int32(3), t.flaky.calls.Load())
+}
+
+func (t *CircuitBreakerTest) TestClosesAfterProbe() {
+	t.flaky.down.Store(true)
+	for i := 0; i < 3; i++ {
+		t.repo.GetValue(t.ctx, "key", new(int))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// the probe fails, so the circuit opens for another cooldown
+	t.NotErrorIs(t.repo.GetValue(t.ctx, "key", new(int)), cache.ErrCircuitOpen)
+	t.ErrorIs(t.repo.GetValue(t.ctx, "key", new(int)), cache.ErrCircuitOpen)
+
+	t.flaky.down.Store(false)
+	time.Sleep(150 * time.Millisecond)
+
+	t.ErrorIs(t.repo.GetValue(t.ctx, "key", new(int)), redis.Nil)
+	t.ErrorIs(t.repo.GetValue(t.ctx, "key", new(int)), redis.Nil)
+	t.Equal([]bool{true, false}, t.changes)
+}
+
+func (t *CircuitBreakerTest) TestIgnoresMissingKeysAndCancelledCalls() {
+	for i := 0; i < 5; i++ {
+		t.ErrorIs(t.repo.GetValue(t.ctx, "missing", new(int)), redis.Nil)
+	}
+
+	t.flaky.down.Store(true)
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+	for i := 0; i < 5; i++ {
+		t.repo.GetValue(ctx, "key", new(int))
+	}
+
+	t.Empty(t.changes)
+	t.Equal(int32(10), t.flaky.calls.Load())
+}
+
+func (t *CircuitBreakerTest) TestSuccessResetsFailures() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "key", 1, 60))
+
+	for i := 0; i < 3; i++ {
+		t.flaky.down.Store(true)
+		t.repo.GetValue(t.ctx, "key", new(int))
+		t.repo.GetValue(t.ctx, "key", new(int))
+		t.flaky.down.Store(false)
+		t.NoError(t.repo.GetValue(t.ctx, "key", new(int)))
+	}
+
+	t.Empty(t.changes)
+}
+
+func (t *CircuitBreakerTest) TestDisabled() {
+	flaky := &flakyRepository{Repository: cache.NewMemoryRepository(cache.Options{})}
+	t.Same(flaky, cache.NewCircuitBreaker(flaky, cache.BreakerOptions{}, zap.NewNop()))
+}
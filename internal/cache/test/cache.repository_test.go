@@ -0,0 +1,375 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+)
+
+// RepositoryContractTest is run against every cache.Repository implementation, so the
+// in-memory one can stand in for redis.
+type RepositoryContractTest struct {
+	suite.Suite
+	newRepository func(opts cache.Options) cache.Repository
+	// client reads redis directly, bypassing the repository. It is nil for other stores.
+	client *redis.Client
+	repo   cache.Repository
+	ctx    context.Context
+	prefix string
+}
+
+type value struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+}
+
+type profileV1 struct {
+	Name string `json:"name"`
+}
+
+func (p profileV1) SchemaVersion() int {
+	return 1
+}
+
+// profileV2 is profileV1 after a release that split the name.
+type profileV2 struct {
+	Name         string `json:"name"`
+	FirstName    string `json:"first_name"`
+	upgradedFrom int
+}
+
+func (p profileV2) SchemaVersion() int {
+	return 2
+}
+
+func (p *profileV2) UpgradeFrom(version int) error {
+	p.FirstName = strings.Fields(p.Name)[0]
+	p.upgradedFrom = version
+	return nil
+}
+
+func TestMemoryRepository(t *testing.T) {
+	suite.Run(t, &RepositoryContractTest{newRepository: cache.NewMemoryRepository})
+}
+
+// TestRedisRepository runs the contract against the redis at REDIS_TEST_ADDR, e.g.
+// REDIS_TEST_ADDR=localhost:6379 REDIS_TEST_PASSWORD=5678 go test ./internal/cache/...
+func TestRedisRepository(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: os.Getenv("REDIS_TEST_PASSWORD")})
+	t.Cleanup(func() { client.Close() })
+
+	suite.Run(t, &RepositoryContractTest{
+		newRepository: func(opts cache.Options) cache.Repository { return cache.NewRepository(client, opts) },
+		client:        client,
+	})
+}
+
+func (t *RepositoryContractTest) SetupTest() {
+	// keeps tests apart on a shared redis
+	t.prefix = fmt.Sprintf("test:%s:", uuid.NewString())
+	t.repo = t.newRepository(cache.Options{KeyPrefix: t.prefix})
+	t.ctx = context.Background()
+}
+
+func (t *RepositoryContractTest) TestSetGetValue() {
+	in := &value{Name: "name", Count: 3, Tags: []string{"a", "b"}}
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", in, 60))
+
+	out := &value{}
+	t.Require().NoError(t.repo.GetValue(t.ctx, "value", out))
+	t.Equal(in, out)
+
+	var list []string
+	t.Require().NoError(t.repo.SetValue(t.ctx, "list", []string{"x"}, 60))
+	t.Require().NoError(t.repo.GetValue(t.ctx, "list", &list))
+	t.Equal([]string{"x"}, list)
+}
+
+func (t *RepositoryContractTest) TestGetValueMissing() {
+	err := t.repo.GetValue(t.ctx, "missing", &value{})
+	t.ErrorIs(err, redis.Nil)
+}
+
+func (t *RepositoryContractTest) TestValueExpires() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", &value{Name: "name"}, 1))
+
+	time.Sleep(1100 * time.Millisecond)
+
+	t.ErrorIs(t.repo.GetValue(t.ctx, "value", &value{}), redis.Nil)
+	ok, err := t.repo.SetValueNX(t.ctx, "value", &value{Name: "again"}, 60)
+	t.Require().NoError(err)
+	t.True(ok)
+}
+
+func (t *RepositoryContractTest) TestGetValues() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "a", &value{Name: "a"}, 60))
+	t.Require().NoError(t.repo.SetValue(t.ctx, "c", &value{Name: "c"}, 60))
+
+	a, b, c := &value{}, &value{}, &value{}
+	found, err := t.repo.GetValues(t.ctx, []string{"a", "b", "c"}, []interface{}{a, b, c})
+	t.Require().NoError(err)
+	t.Equal([]bool{true, false, true}, found)
+	t.Equal("a", a.Name)
+	t.Empty(b.Name)
+	t.Equal("c", c.Name)
+
+	found, err = t.repo.GetValues(t.ctx, nil, nil)
+	t.Require().NoError(err)
+	t.Empty(found)
+}
+
+func (t *RepositoryContractTest) TestGetDelValue() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", &value{Name: "name"}, 60))
+
+	out := &value{}
+	t.Require().NoError(t.repo.GetDelValue(t.ctx, "value", out))
+	t.Equal("name", out.Name)
+
+	t.ErrorIs(t.repo.GetDelValue(t.ctx, "value", out), redis.Nil)
+	t.ErrorIs(t.repo.GetValue(t.ctx, "value", out), redis.Nil)
+}
+
+func (t *RepositoryContractTest) TestGetDelValueConcurrent() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", &value{Name: "name"}, 60))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if t.repo.GetDelValue(t.ctx, "value", &value{}) == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	t.Equal(1, taken)
+}
+
+func (t *RepositoryContractTest) TestDeleteValues() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "a", 1, 60))
+	t.Require().NoError(t.repo.SetValue(t.ctx, "b", 2, 60))
+
+	t.Require().NoError(t.repo.DeleteValues(t.ctx, "a", "b", "missing"))
+	t.Require().NoError(t.repo.DeleteValues(t.ctx))
+	t.Require().NoError(t.repo.DeleteValue(t.ctx, "missing"))
+
+	var n int
+	t.ErrorIs(t.repo.GetValue(t.ctx, "a", &n), redis.Nil)
+	t.ErrorIs(t.repo.GetValue(t.ctx, "b", &n), redis.Nil)
+}
+
+func (t *RepositoryContractTest) TestSetValueNXConcurrent() {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := t.repo.SetValueNX(t.ctx, "value", i, 60)
+			if err == nil && ok {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	t.Equal(1, won)
+}
+
+func (t *RepositoryContractTest) TestSetValues() {
+	for _, set := range []func(context.Context, ...cache.Entry) error{t.repo.SetValues, t.repo.SetValuesPipelined} {
+		t.Require().NoError(set(t.ctx,
+			cache.Entry{Key: "a", Value: &value{Name: "a"}, TTL: 60},
+			cache.Entry{Key: "b", Value: "b", TTL: 60},
+		))
+		t.Require().NoError(set(t.ctx))
+
+		a, b := &value{}, ""
+		t.Require().NoError(t.repo.GetValue(t.ctx, "a", a))
+		t.Require().NoError(t.repo.GetValue(t.ctx, "b", &b))
+		t.Equal("a", a.Name)
+		t.Equal("b", b)
+
+		t.Require().NoError(t.repo.DeleteValues(t.ctx, "a", "b"))
+	}
+}
+
+func (t *RepositoryContractTest) TestFields() {
+	fields, err := t.repo.GetFields(t.ctx, "hash")
+	t.Require().NoError(err)
+	t.Empty(fields)
+
+	t.Require().NoError(t.repo.SetField(t.ctx, "hash", "a", 1))
+	t.Require().NoError(t.repo.SetField(t.ctx, "hash", "b", "two"))
+	t.Require().NoError(t.repo.SetField(t.ctx, "hash", "a", 3))
+
+	fields, err = t.repo.GetFields(t.ctx, "hash")
+	t.Require().NoError(err)
+	t.Equal(map[string]string{"a": "3", "b": `"two"`}, fields)
+
+	t.Require().NoError(t.repo.DeleteFields(t.ctx, "hash", "a", "missing"))
+	fields, err = t.repo.GetFields(t.ctx, "hash")
+	t.Require().NoError(err)
+	t.Equal(map[string]string{"b": `"two"`}, fields)
+
+	t.Require().NoError(t.repo.DeleteFields(t.ctx, "hash", "b"))
+	t.Require().NoError(t.repo.DeleteFields(t.ctx, "missing", "b"))
+	t.Require().NoError(t.repo.DeleteValue(t.ctx, "hash"))
+}
+
+func (t *RepositoryContractTest) TestExpire() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", 1, 0))
+	t.Require().NoError(t.repo.SetField(t.ctx, "hash", "a", 1))
+	t.Require().NoError(t.repo.SetValue(t.ctx, "deleted", 1, 60))
+
+	t.Require().NoError(t.repo.Expire(t.ctx, "value", 1))
+	t.Require().NoError(t.repo.Expire(t.ctx, "hash", 1))
+	t.Require().NoError(t.repo.Expire(t.ctx, "deleted", 0))
+	t.Require().NoError(t.repo.Expire(t.ctx, "missing", 60))
+
+	var n int
+	t.ErrorIs(t.repo.GetValue(t.ctx, "deleted", &n), redis.Nil)
+	t.Require().NoError(t.repo.GetValue(t.ctx, "value", &n))
+
+	time.Sleep(1100 * time.Millisecond)
+
+	t.ErrorIs(t.repo.GetValue(t.ctx, "value", &n), redis.Nil)
+	t.ErrorIs(t.repo.GetValue(t.ctx, "missing", &n), redis.Nil)
+	fields, err := t.repo.GetFields(t.ctx, "hash")
+	t.Require().NoError(err)
+	t.Empty(fields)
+}
+
+func (t *RepositoryContractTest) TestWrongType() {
+	t.Require().NoError(t.repo.SetField(t.ctx, "hash", "a", 1))
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", &value{Name: "name"}, 60))
+
+	wrongType := func(err error) {
+		t.True(cache.IsWrongType(err), err)
+		// redis was reached, so this is no reason to open the circuit breaker
+		t.NotErrorIs(err, apperror.CacheUnavailable)
+	}
+
+	wrongType(t.repo.GetValue(t.ctx, "hash", &value{}))
+	wrongType(t.repo.GetDelValue(t.ctx, "hash", &value{}))
+	_, err := t.repo.GetValues(t.ctx, []string{"value", "hash"}, []interface{}{&value{}, &value{}})
+	wrongType(err)
+	wrongType(t.repo.SetField(t.ctx, "value", "a", 1))
+	_, err = t.repo.GetFields(t.ctx, "value")
+	wrongType(err)
+
+	// a failed GetDelValue leaves the hash in place
+	fields, err := t.repo.GetFields(t.ctx, "hash")
+	t.Require().NoError(err)
+	t.Equal(map[string]string{"a": "1"}, fields)
+}
+
+func (t *RepositoryContractTest) TestCancelledContext() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	t.ErrorIs(t.repo.SetValue(ctx, "value", 1, 60), context.Canceled)
+	t.ErrorIs(t.repo.GetValue(ctx, "value", new(int)), context.Canceled)
+}
+
+func (t *RepositoryContractTest) TestBinaryCodec() {
+	repo := t.newRepository(cache.Options{KeyPrefix: t.prefix, Binary: true})
+	session := &dto.Session{
+		ID:               "session-id",
+		UserID:           "user-id",
+		Role:             constant.STAFF,
+		Device:           "device",
+		ClientId:         "client",
+		Audience:         []string{"gateway", "checkin"},
+		AccessTokenId:    "token-id",
+		RefreshTokenHash: "hash",
+		ActorId:          "staff-id",
+		CreatedAt:        time.Unix(1700000000, 123),
+		LastSeenAt:       time.Unix(1700000600, 456),
+	}
+	refreshCache := &dto.RefreshTokenCache{UserID: "user-id", Role: constant.USER, SessionID: "session-id"}
+	t.Require().NoError(repo.SetValues(t.ctx,
+		cache.Entry{Key: "session", Value: session, TTL: 60},
+		cache.Entry{Key: "refresh", Value: refreshCache, TTL: 60},
+	))
+
+	outSession, outRefresh := &dto.Session{}, &dto.RefreshTokenCache{}
+	found, err := repo.GetValues(t.ctx, []string{"session", "refresh"}, []interface{}{outSession, outRefresh})
+	t.Require().NoError(err)
+	t.Equal([]bool{true, true}, found)
+	t.Equal(session, outSession)
+	t.Equal(refreshCache, outRefresh)
+
+	// values without a binary form are still stored as JSON
+	t.Require().NoError(repo.SetValue(t.ctx, "value", &value{Name: "name"}, 60))
+	out := &value{}
+	t.Require().NoError(repo.GetValue(t.ctx, "value", out))
+	t.Equal("name", out.Name)
+}
+
+func (t *RepositoryContractTest) TestSchemaUpgrade() {
+	t.Require().NoError(t.repo.SetValue(t.ctx, "old", &profileV1{Name: "Somchai Jaidee"}, 60))
+	t.Require().NoError(t.repo.SetValue(t.ctx, "new", &profileV2{Name: "Somsri Jaidee", FirstName: "Somsri"}, 60))
+
+	old := &profileV2{}
+	t.Require().NoError(t.repo.GetValue(t.ctx, "old", old))
+	t.Equal(1, old.upgradedFrom)
+	t.Equal("Somchai", old.FirstName)
+
+	current := &profileV2{}
+	t.Require().NoError(t.repo.GetValue(t.ctx, "new", current))
+	t.Zero(current.upgradedFrom)
+	t.Equal("Somsri", current.FirstName)
+}
+
+func (t *RepositoryContractTest) TestLegacyValue() {
+	if t.client == nil {
+		t.T().Skip("needs direct access to redis")
+	}
+
+	// written as plain JSON before values had an envelope
+	t.Require().NoError(t.client.Set(t.ctx, t.prefix+"legacy", `{"name":"Somchai Jaidee"}`, time.Minute).Err())
+
+	legacy := &profileV2{}
+	t.Require().NoError(t.repo.GetValue(t.ctx, "legacy", legacy))
+	t.Equal(0, legacy.upgradedFrom)
+	t.Equal("Somchai", legacy.FirstName)
+}
+
+func (t *RepositoryContractTest) TestKeyPrefix() {
+	if t.client == nil {
+		t.T().Skip("needs direct access to redis")
+	}
+
+	t.Require().NoError(t.repo.SetValue(t.ctx, "value", 1, 60))
+
+	t.Equal(int64(1), t.client.Exists(t.ctx, t.prefix+"value").Val())
+	t.Equal(int64(0), t.client.Exists(t.ctx, "value").Val())
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TimeoutTest runs the redis repository against a server that accepts connections and never
+// answers, as a redis that stopped responding would.
+type TimeoutTest struct {
+	suite.Suite
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+	client   *redis.Client
+	repo     cache.Repository
+	ctx      context.Context
+}
+
+func TestTimeout(t *testing.T) {
+	suite.Run(t, new(TimeoutTest))
+}
+
+func (t *TimeoutTest) SetupTest() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	t.Require().NoError(err)
+	t.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.conns = append(t.conns, conn)
+			t.mu.Unlock()
+		}
+	}()
+
+	t.client = redis.NewClient(&redis.Options{Addr: listener.Addr().String(), ContextTimeoutEnabled: true, MaxRetries: -1})
+	t.repo = cache.NewRepository(t.client, cache.Options{Timeout: 100 * time.Millisecond})
+	t.ctx = context.Background()
+}
+
+func (t *TimeoutTest) TearDownTest() {
+	t.client.Close()
+	t.listener.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+}
+
+func (t *TimeoutTest) TestCacheTimeout() {
+	err := t.repo.GetValue(t.ctx, "key", new(int))
+
+	t.ErrorIs(err, apperror.CacheUnavailable)
+	t.Equal(codes.Unavailable, status.Code(apperror.ToStatus(err)))
+}
+
+func (t *TimeoutTest) TestCallerDeadline() {
+	ctx, cancel := context.WithTimeout(t.ctx, 20*time.Millisecond)
+	defer cancel()
+
+	err := t.repo.GetValue(ctx, "key", new(int))
+
+	t.ErrorIs(err, context.DeadlineExceeded)
+	t.NotErrorIs(err, apperror.CacheUnavailable)
+	t.Equal(codes.DeadlineExceeded, status.Code(apperror.ToStatus(err)))
+}
+
+func (t *TimeoutTest) TestCallerCancelled() {
+	ctx, cancel := context.WithCancel(t.ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	err := t.repo.GetValue(ctx, "key", new(int))
+
+	t.ErrorIs(err, context.Canceled)
+	t.NotErrorIs(err, apperror.CacheUnavailable)
+	t.Equal(codes.Canceled, status.Code(apperror.ToStatus(err)))
+}
@@ -0,0 +1,89 @@
+package dto
+
+type SignOutRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+type SignOutResponse struct {
+	Success bool `json:"success"`
+}
+
+type SignOutAllDevicesRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+type SignOutAllDevicesResponse struct {
+	Success bool `json:"success"`
+}
+
+type IntrospectRequest struct {
+	Token         string `json:"token"`
+	TokenTypeHint string `json:"token_type_hint"`
+}
+
+type IntrospectResponse struct {
+	TokenIntrospection
+}
+
+// PermissionRequest targets either a role or a user.
+type PermissionRequest struct {
+	AccessToken string `json:"access_token"`
+	Role        string `json:"role"`
+	UserId      string `json:"user_id"`
+	Permission  string `json:"permission"`
+}
+
+type PermissionResponse struct {
+	Success bool `json:"success"`
+}
+
+type ListPermissionsRequest struct {
+	AccessToken string `json:"access_token"`
+	Role        string `json:"role"`
+	UserId      string `json:"user_id"`
+}
+
+type ListPermissionsResponse struct {
+	Permissions []string `json:"permissions"`
+}
+
+type ClientCredentialsRequest struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+type ClientCredentialsResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// ImpersonateRequest is sent by a staff member, identified by AccessToken, to act as UserId.
+type ImpersonateRequest struct {
+	AccessToken string `json:"access_token"`
+	UserId      string `json:"user_id"`
+	Reason      string `json:"reason"`
+}
+
+type ImpersonateResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type CreateQrTokenRequest struct {
+	AccessToken string `json:"access_token"`
+	Purpose     string `json:"purpose"`
+}
+
+type CreateQrTokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+type RedeemQrTokenRequest struct {
+	Token   string `json:"token"`
+	Purpose string `json:"purpose"`
+}
+
+type RedeemQrTokenResponse struct {
+	UserId string `json:"user_id"`
+}
@@ -1,5 +1,16 @@
 package dto
 
+import "time"
+
 type GoogleUserEmailResponse struct {
 	Email string `json:"email"`
 }
+
+// OauthLoginAttempt is kept under the state of a login attempt until the user comes back from
+// Google with it. BindingHash is the SHA-256 of the value that ties the attempt to the browser
+// that started it.
+type OauthLoginAttempt struct {
+	CodeVerifier string    `json:"code_verifier"`
+	BindingHash  string    `json:"binding_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
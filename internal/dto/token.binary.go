@@ -0,0 +1,176 @@
+package dto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sessions and refresh tokens are read on every validation and refresh, so they also have a
+// compact binary form in the protobuf wire format. Field numbers must never be reused.
+
+func (s Session) SchemaVersion() int {
+	return 1
+}
+
+func (s Session) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, s.ID)
+	b = appendString(b, 2, s.UserID)
+	b = appendString(b, 3, string(s.Role))
+	b = appendString(b, 4, s.Device)
+	b = appendString(b, 5, s.ClientId)
+	for _, audience := range s.Audience {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, audience)
+	}
+	b = appendString(b, 7, s.AccessTokenId)
+	b = appendString(b, 8, s.RefreshTokenHash)
+	b = appendString(b, 10, s.ActorId)
+	b = appendTime(b, 11, s.CreatedAt)
+	b = appendTime(b, 12, s.LastSeenAt)
+
+	return b, nil
+}
+
+func (s *Session) UnmarshalBinary(data []byte) error {
+	*s = Session{}
+
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &s.ID)
+		case 2:
+			return consumeString(typ, b, &s.UserID)
+		case 3:
+			var role string
+			n, err := consumeString(typ, b, &role)
+			s.Role = constant.Role(role)
+			return n, err
+		case 4:
+			return consumeString(typ, b, &s.Device)
+		case 5:
+			return consumeString(typ, b, &s.ClientId)
+		case 6:
+			var audience string
+			n, err := consumeString(typ, b, &audience)
+			s.Audience = append(s.Audience, audience)
+			return n, err
+		case 7:
+			return consumeString(typ, b, &s.AccessTokenId)
+		case 8:
+			return consumeString(typ, b, &s.RefreshTokenHash)
+		case 10:
+			return consumeString(typ, b, &s.ActorId)
+		case 11:
+			return consumeTime(typ, b, &s.CreatedAt)
+		case 12:
+			return consumeTime(typ, b, &s.LastSeenAt)
+		default:
+			return -1, nil
+		}
+	})
+}
+
+func (r RefreshTokenCache) SchemaVersion() int {
+	return 1
+}
+
+func (r RefreshTokenCache) MarshalBinary() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, r.UserID)
+	b = appendString(b, 2, string(r.Role))
+	b = appendString(b, 3, r.SessionID)
+
+	return b, nil
+}
+
+func (r *RefreshTokenCache) UnmarshalBinary(data []byte) error {
+	*r = RefreshTokenCache{}
+
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, b, &r.UserID)
+		case 2:
+			var role string
+			n, err := consumeString(typ, b, &role)
+			r.Role = constant.Role(role)
+			return n, err
+		case 3:
+			return consumeString(typ, b, &r.SessionID)
+		default:
+			return -1, nil
+		}
+	})
+}
+
+var errWireType = errors.New("unexpected wire type")
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendTime stores the time as Unix nanoseconds, which drops the location.
+func appendTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixNano()))
+}
+
+func consumeString(typ protowire.Type, b []byte, v *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, errWireType
+	}
+
+	s, n := protowire.ConsumeString(b)
+	*v = s
+	return n, protowire.ParseError(n)
+}
+
+func consumeTime(typ protowire.Type, b []byte, t *time.Time) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, errWireType
+	}
+
+	v, n := protowire.ConsumeVarint(b)
+	*t = time.Unix(0, int64(v))
+	return n, protowire.ParseError(n)
+}
+
+// consumeFields calls field for every field in b. field returns how many bytes of the value it
+// consumed, or -1 to skip an unknown field, which is what lets older releases read values
+// written by newer ones.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := field(num, typ, b)
+		if n < 0 && err == nil {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package dto
 
 import (
+	"time"
+
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/isd-sgcu/rpkm67-model/constant"
 )
@@ -12,19 +14,152 @@ type Credentials struct {
 }
 
 type UserCredentials struct {
-	UserID string        `json:"user_id"`
-	Role   constant.Role `json:"role"`
+	UserID    string        `json:"user_id"`
+	Role      constant.Role `json:"role"`
+	SessionID string        `json:"session_id"`
+	TokenID   string        `json:"token_id"`
+	Issuer    string        `json:"issuer"`
+	Audience  []string      `json:"audience"`
+	Scopes    []string      `json:"scopes"`
+	ActorID   string        `json:"actor_id,omitempty"`
+	IssuedAt  time.Time     `json:"issued_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
 }
 
 type AuthPayload struct {
 	jwt.RegisteredClaims
-	UserId string        `json:"user_id"`
-	Role   constant.Role `json:"role"`
+	UserId    string        `json:"user_id"`
+	Role      constant.Role `json:"role"`
+	SessionId string        `json:"session_id,omitempty"`
+	Scope     string        `json:"scope,omitempty"`
+	ClientId  string        `json:"client_id,omitempty"`
+	TokenUse  string        `json:"token_use,omitempty"`
+	Act       *ActorClaim   `json:"act,omitempty"`
+	Purpose   string        `json:"purpose,omitempty"`
+}
+
+// TokenPayload is what a signed token carries, independent of the token format.
+type TokenPayload struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	TokenId   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	UserId    string
+	Role      constant.Role
+	SessionId string
+	Scopes    []string
+	ClientId  string
+	TokenUse  string
+	Purpose   string
+	ActorId   string
+}
+
+// ActorClaim is the RFC 8693 act claim naming the staff member acting as the token's user.
+type ActorClaim struct {
+	Sub string `json:"sub"`
+}
+
+// TokenClaims are the claims a new access token is signed with.
+type TokenClaims struct {
+	UserId    string
+	Role      constant.Role
+	SessionId string
+	TokenId   string
+	Audience  []string
+	Scopes    []string
+	ActorId   string
+	// TTL is the lifetime of the token in seconds, or the configured access TTL when zero.
+	TTL int
+}
+
+// ServiceCredentials identify an rpkm67 service authenticated with a machine token.
+type ServiceCredentials struct {
+	ClientId  string    `json:"client_id"`
+	TokenID   string    `json:"token_id"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
+// ClientInfo describes the client a session is created for.
+type ClientInfo struct {
+	Device   string
+	ClientId string
+	// Audience is the audience requested by the client, or all it may request when empty.
+	Audience []string
+}
+
+// RefreshTokenCache is stored for every refresh token issued in a session. All refresh tokens
+// of one session form a family; a rotated token is kept, together with its RefreshRotation,
+// so that a replay of it can be told apart from an unknown or expired token.
 type RefreshTokenCache struct {
-	UserID string        `json:"user_id"`
-	Role   constant.Role `json:"role"`
+	UserID    string        `json:"user_id"`
+	Role      constant.Role `json:"role"`
+	SessionID string        `json:"session_id"`
+}
+
+// RefreshRotation is written, with SET NX, by the one refresh that gets to rotate a refresh
+// token. Any other refresh with the same token finds it and either waits for the successor or
+// is treated as reuse.
+type RefreshRotation struct {
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+type Session struct {
+	ID            string        `json:"id"`
+	UserID        string        `json:"user_id"`
+	Role          constant.Role `json:"role"`
+	Device        string        `json:"device"`
+	ClientId      string        `json:"client_id"`
+	Audience      []string      `json:"audience"`
+	AccessTokenId string        `json:"access_token_id"`
+	// RefreshTokenHash is the keyed hash of the session's latest refresh token. The token
+	// itself is never stored.
+	RefreshTokenHash string `json:"refresh_token_hash"`
+	// ActorId is set on impersonation sessions, which have no refresh token.
+	ActorId    string    `json:"actor_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+const (
+	AccessTokenType  = "access_token"
+	RefreshTokenType = "refresh_token"
+	// ServiceTokenUse marks machine tokens so they are never accepted as user tokens.
+	ServiceTokenUse = "service"
+	// QrTokenUse marks single-use tokens shown as a QR code, which are only good for their purpose.
+	QrTokenUse = "qr"
+)
+
+// TokenIntrospection follows RFC 7662. An inactive token only has Active set.
+type TokenIntrospection struct {
+	Active    bool        `json:"active"`
+	Scope     string      `json:"scope,omitempty"`
+	TokenType string      `json:"token_type,omitempty"`
+	Exp       int64       `json:"exp,omitempty"`
+	Iat       int64       `json:"iat,omitempty"`
+	Sub       string      `json:"sub,omitempty"`
+	Iss       string      `json:"iss,omitempty"`
+	Aud       []string    `json:"aud,omitempty"`
+	ClientId  string      `json:"client_id,omitempty"`
+	Jti       string      `json:"jti,omitempty"`
+	SessionId string      `json:"sid,omitempty"`
+	Role      string      `json:"role,omitempty"`
+	Act       *ActorClaim `json:"act,omitempty"`
+}
+
+// QrToken is a short-lived token a user shows as a QR code. It can be redeemed once.
+type QrToken struct {
+	Token     string `json:"token"`
+	Purpose   string `json:"purpose"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// QrTokenRedemption identifies the user a redeemed QR token was issued to.
+type QrTokenRedemption struct {
+	UserID  string `json:"user_id"`
+	Purpose string `json:"purpose"`
+	TokenID string `json:"token_id"`
 }
 
 type ResetPasswordTokenCache struct {
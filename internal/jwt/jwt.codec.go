@@ -0,0 +1,158 @@
+package jwt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/pkg/errors"
+)
+
+const (
+	FormatJwt    = "jwt"
+	FormatPaseto = "paseto"
+)
+
+// Codec signs a TokenPayload into a token string and verifies it back. Decode returns
+// apperror.TokenExpired for expired tokens and apperror.InvalidToken for anything else.
+type Codec interface {
+	Encode(payload *dto.TokenPayload) (string, error)
+	Decode(token string) (*dto.TokenPayload, error)
+	// Handles reports whether the token is in the codec's format, without verifying it.
+	Handles(token string) bool
+}
+
+// NewCodec returns a codec that issues tokens in the given format and reads tokens in every
+// format, so changing JWT_TOKEN_FORMAT does not invalidate tokens already handed out.
+func NewCodec(format string, keys KeyStore, strategy JwtStrategy, jwtUtils JwtUtils) (Codec, error) {
+	jwtCodec := NewJwtCodec(keys, strategy, jwtUtils)
+	pasetoCodec := NewPasetoCodec(keys)
+
+	var encoder Codec
+	switch format {
+	case "", FormatJwt:
+		encoder = jwtCodec
+	case FormatPaseto:
+		if _, err := ed25519SigningKey(keys.SigningKey()); err != nil {
+			return nil, err
+		}
+		encoder = pasetoCodec
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported token format %s", format))
+	}
+
+	return &formatCodec{encoder: encoder, decoders: []Codec{pasetoCodec, jwtCodec}}, nil
+}
+
+type formatCodec struct {
+	encoder  Codec
+	decoders []Codec
+}
+
+func (c *formatCodec) Encode(payload *dto.TokenPayload) (string, error) {
+	return c.encoder.Encode(payload)
+}
+
+func (c *formatCodec) Decode(token string) (*dto.TokenPayload, error) {
+	for _, decoder := range c.decoders {
+		if decoder.Handles(token) {
+			return decoder.Decode(token)
+		}
+	}
+
+	return nil, apperror.InvalidToken.Wrap(errors.New("unknown token format"))
+}
+
+func (c *formatCodec) Handles(token string) bool {
+	for _, decoder := range c.decoders {
+		if decoder.Handles(token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type jwtCodecImpl struct {
+	keys     KeyStore
+	strategy JwtStrategy
+	jwtUtils JwtUtils
+}
+
+// NewJwtCodec reads and writes JWTs signed with the key store's keys, with the key id in the
+// kid header.
+func NewJwtCodec(keys KeyStore, strategy JwtStrategy, jwtUtils JwtUtils) Codec {
+	return &jwtCodecImpl{keys: keys, strategy: strategy, jwtUtils: jwtUtils}
+}
+
+func (c *jwtCodecImpl) Encode(payload *dto.TokenPayload) (string, error) {
+	claims := dto.AuthPayload{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    payload.Issuer,
+			Subject:   payload.Subject,
+			Audience:  payload.Audience,
+			ExpiresAt: c.jwtUtils.GetNumericDate(payload.ExpiresAt),
+			IssuedAt:  c.jwtUtils.GetNumericDate(payload.IssuedAt),
+			ID:        payload.TokenId,
+		},
+		UserId:    payload.UserId,
+		Role:      payload.Role,
+		SessionId: payload.SessionId,
+		Scope:     strings.Join(payload.Scopes, " "),
+		ClientId:  payload.ClientId,
+		TokenUse:  payload.TokenUse,
+		Purpose:   payload.Purpose,
+	}
+	if payload.ActorId != "" {
+		claims.Act = &dto.ActorClaim{Sub: payload.ActorId}
+	}
+
+	key := c.keys.SigningKey()
+	token := c.jwtUtils.GenerateJwtToken(key.Method, claims)
+	token.Header["kid"] = key.Id
+
+	return c.jwtUtils.SignedTokenString(token, key.SignKey)
+}
+
+func (c *jwtCodecImpl) Decode(token string) (*dto.TokenPayload, error) {
+	claims := &dto.AuthPayload{}
+	if _, err := c.jwtUtils.ParseTokenWithClaims(token, claims, c.strategy.AuthDecode); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, apperror.TokenExpired.Wrap(err)
+		}
+		return nil, apperror.InvalidToken.Wrap(err)
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, apperror.InvalidToken.Wrap(errors.New("exp not found in payloads"))
+	}
+
+	payload := &dto.TokenPayload{
+		Issuer:    claims.Issuer,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		TokenId:   claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+		UserId:    claims.UserId,
+		Role:      claims.Role,
+		SessionId: claims.SessionId,
+		Scopes:    strings.Fields(claims.Scope),
+		ClientId:  claims.ClientId,
+		TokenUse:  claims.TokenUse,
+		Purpose:   claims.Purpose,
+	}
+	if claims.IssuedAt != nil {
+		payload.IssuedAt = claims.IssuedAt.Time
+	}
+	if claims.Act != nil {
+		payload.ActorId = claims.Act.Sub
+	}
+
+	return payload, nil
+}
+
+func (c *jwtCodecImpl) Handles(token string) bool {
+	return strings.Count(token, ".") == 2 && !strings.HasPrefix(token, pasetoPublicHeader)
+}
@@ -0,0 +1,115 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"go.uber.org/zap"
+)
+
+const JwksPath = "/.well-known/jwks.json"
+
+// BuildJwks returns the public half of every asymmetric verification key. HMAC secrets are
+// never published, so the document is empty while the service signs with JWT_SECRET.
+func BuildJwks(keys []*Key) *dto.JWKS {
+	jwks := &dto.JWKS{Keys: []dto.JWK{}}
+
+	for _, key := range keys {
+		switch pub := key.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, dto.JWK{
+				Kty: "RSA",
+				Kid: key.Id,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				N:   encodeBase64Url(pub.N.Bytes()),
+				E:   encodeBase64Url(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwks.Keys = append(jwks.Keys, dto.JWK{
+				Kty: "EC",
+				Kid: key.Id,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: pub.Curve.Params().Name,
+				X:   encodeBase64Url(pub.X.FillBytes(make([]byte, size))),
+				Y:   encodeBase64Url(pub.Y.FillBytes(make([]byte, size))),
+			})
+		case ed25519.PublicKey:
+			jwks.Keys = append(jwks.Keys, dto.JWK{
+				Kty: "OKP",
+				Kid: key.Id,
+				Use: "sig",
+				Alg: key.Method.Alg(),
+				Crv: "Ed25519",
+				X:   encodeBase64Url(pub),
+			})
+		}
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].Kid < jwks.Keys[j].Kid })
+
+	return jwks
+}
+
+type jwksHandler struct {
+	keys   KeyStore
+	maxAge int
+	log    *zap.Logger
+}
+
+// NewJwksHandler serves the JWKS document with cache headers so verifiers only refetch it
+// when a key they have not seen shows up or the max age passes.
+func NewJwksHandler(keys KeyStore, maxAge int, log *zap.Logger) http.Handler {
+	return &jwksHandler{keys: keys, maxAge: maxAge, log: log}
+}
+
+func (h *jwksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(BuildJwks(h.keys.VerificationKeys()))
+	if err != nil {
+		h.log.Named("ServeHTTP").Error("Marshal: ", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:8]))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", h.maxAge))
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := w.Write(body); err != nil {
+		h.log.Named("ServeHTTP").Error("Write: ", zap.Error(err))
+	}
+}
+
+func encodeBase64Url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
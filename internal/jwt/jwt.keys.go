@@ -0,0 +1,341 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultKeyId     = "default"
+	keyFileExtension = ".pem"
+	manifestFileName = "keys.json"
+)
+
+// Key is a signing key together with the key used to verify its signatures. For HMAC both
+// are the shared secret.
+type Key struct {
+	Id        string
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+}
+
+// KeyStore holds the key used to sign new tokens and every key whose tokens are still
+// accepted. Keys are rotated by adding a new key, activating it for signing and retiring
+// the old one once the tokens it signed have expired.
+type KeyStore interface {
+	SigningKey() *Key
+	VerificationKey(kid string) (*Key, error)
+	VerificationKeys() []*Key
+	Activate(kid string) error
+	Retire(kid string) error
+	Reload() error
+}
+
+// KeyManifest records which key in the keys directory signs new tokens and which keys are
+// no longer accepted.
+type KeyManifest struct {
+	Active  string   `json:"active"`
+	Retired []string `json:"retired"`
+}
+
+type keyStoreImpl struct {
+	mu      sync.RWMutex
+	config  config.JwtConfig
+	active  *Key
+	keys    map[string]*Key
+	retired map[string]bool
+}
+
+// NewKeyStore loads PEM keys from config.KeysDir. When no directory is configured tokens are
+// signed with the HS256 secret, as before.
+func NewKeyStore(config config.JwtConfig) (KeyStore, error) {
+	s := &keyStoreImpl{config: config}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *keyStoreImpl) SigningKey() *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.active
+}
+
+func (s *keyStoreImpl) VerificationKey(kid string) (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// tokens issued before key ids were introduced have no kid and were signed with the secret
+	if kid == "" && s.config.KeysDir == "" {
+		return s.active, nil
+	}
+
+	key, ok := s.keys[kid]
+	if !ok || s.retired[kid] {
+		return nil, errors.New(fmt.Sprintf("unknown signing key %q", kid))
+	}
+
+	return key, nil
+}
+
+func (s *keyStoreImpl) VerificationKeys() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]*Key, 0, len(s.keys))
+	for kid, key := range s.keys {
+		if !s.retired[kid] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (s *keyStoreImpl) Activate(kid string) error {
+	if s.config.KeysDir == "" {
+		return errors.New("key rotation requires JWT_KEYS_DIR")
+	}
+
+	if err := s.Reload(); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	_, ok := s.keys[kid]
+	retired := s.retired[kid]
+	s.mu.RUnlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("key %q not found in %s", kid, s.config.KeysDir))
+	}
+	if retired {
+		return errors.New(fmt.Sprintf("key %q has been retired", kid))
+	}
+
+	manifest, err := ReadKeyManifest(s.config.KeysDir)
+	if err != nil {
+		return err
+	}
+	manifest.Active = kid
+
+	if err := WriteKeyManifest(s.config.KeysDir, manifest); err != nil {
+		return err
+	}
+
+	return s.Reload()
+}
+
+func (s *keyStoreImpl) Retire(kid string) error {
+	if s.config.KeysDir == "" {
+		return errors.New("key rotation requires JWT_KEYS_DIR")
+	}
+
+	if err := s.Reload(); err != nil {
+		return err
+	}
+
+	if active := s.SigningKey(); active != nil && active.Id == kid {
+		return errors.New(fmt.Sprintf("key %q is used for signing, activate another key first", kid))
+	}
+
+	manifest, err := ReadKeyManifest(s.config.KeysDir)
+	if err != nil {
+		return err
+	}
+
+	for _, retired := range manifest.Retired {
+		if retired == kid {
+			return nil
+		}
+	}
+	manifest.Retired = append(manifest.Retired, kid)
+
+	if err := WriteKeyManifest(s.config.KeysDir, manifest); err != nil {
+		return err
+	}
+
+	return s.Reload()
+}
+
+func (s *keyStoreImpl) Reload() error {
+	if s.config.KeysDir == "" {
+		kid := s.config.SigningKeyId
+		if kid == "" {
+			kid = defaultKeyId
+		}
+
+		key := &Key{
+			Id:        kid,
+			Method:    jwt.SigningMethodHS256,
+			SignKey:   []byte(s.config.Secret),
+			VerifyKey: []byte(s.config.Secret),
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.active = key
+		s.keys = map[string]*Key{kid: key}
+		s.retired = map[string]bool{}
+
+		return nil
+	}
+
+	keys, err := loadKeys(s.config.KeysDir)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := ReadKeyManifest(s.config.KeysDir)
+	if err != nil {
+		return err
+	}
+
+	retired := map[string]bool{}
+	for _, kid := range manifest.Retired {
+		retired[kid] = true
+	}
+
+	activeId := manifest.Active
+	if activeId == "" {
+		activeId = s.config.SigningKeyId
+	}
+	if current := s.SigningKey(); activeId == "" && current != nil {
+		activeId = current.Id
+	}
+	if activeId == "" && len(keys) == 1 {
+		for kid := range keys {
+			activeId = kid
+		}
+	}
+
+	active, ok := keys[activeId]
+	if !ok || retired[activeId] {
+		return errors.New(fmt.Sprintf("signing key %q not found in %s, set JWT_SIGNING_KEY_ID or activate a key", activeId, s.config.KeysDir))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = active
+	s.keys = keys
+	s.retired = retired
+
+	return nil
+}
+
+func ReadKeyManifest(dir string) (*KeyManifest, error) {
+	manifest := &KeyManifest{}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFileName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func WriteKeyManifest(dir string, manifest *KeyManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write then rename so other replicas never read a partial manifest
+	tmp := filepath.Join(dir, manifestFileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, manifestFileName))
+}
+
+// loadKeys reads every <kid>.pem private key in the directory.
+func loadKeys(dir string) (map[string]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*Key{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != keyFileExtension {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		kid := strings.TrimSuffix(entry.Name(), keyFileExtension)
+		key, err := ParsePrivateKey(kid, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %s", entry.Name())
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+// ParsePrivateKey reads an RSA, ECDSA or Ed25519 private key in PKCS#8, PKCS#1 or SEC 1 form.
+// The signing method is derived from the key type: RS256 for RSA, ES256 for P-256 and EdDSA
+// for Ed25519.
+func ParsePrivateKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &Key{Id: kid, Method: jwt.SigningMethodRS256, SignKey: k, VerifyKey: &k.PublicKey}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+		return &Key{Id: kid, Method: jwt.SigningMethodES256, SignKey: k, VerifyKey: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{Id: kid, Method: jwt.SigningMethodEdDSA, SignKey: k, VerifyKey: k.Public()}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported key type %T", privateKey))
+	}
+}
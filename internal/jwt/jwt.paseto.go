@@ -0,0 +1,218 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/pkg/errors"
+)
+
+const pasetoPublicHeader = "v4.public."
+
+// pasetoClaims uses the PASETO registered claims, whose times are RFC 3339 strings, and the
+// same custom claims as the JWTs.
+type pasetoClaims struct {
+	Issuer    string          `json:"iss,omitempty"`
+	Subject   string          `json:"sub,omitempty"`
+	Audience  []string        `json:"aud,omitempty"`
+	ExpiresAt string          `json:"exp"`
+	IssuedAt  string          `json:"iat,omitempty"`
+	TokenId   string          `json:"jti,omitempty"`
+	UserId    string          `json:"user_id,omitempty"`
+	Role      constant.Role   `json:"role,omitempty"`
+	SessionId string          `json:"session_id,omitempty"`
+	Scope     string          `json:"scope,omitempty"`
+	ClientId  string          `json:"client_id,omitempty"`
+	TokenUse  string          `json:"token_use,omitempty"`
+	Act       *dto.ActorClaim `json:"act,omitempty"`
+	Purpose   string          `json:"purpose,omitempty"`
+}
+
+// pasetoFooter names the key that signed the token, like the kid header of a JWT.
+type pasetoFooter struct {
+	Kid string `json:"kid"`
+}
+
+type pasetoCodecImpl struct {
+	keys KeyStore
+}
+
+// NewPasetoCodec reads and writes PASETO v4.public tokens. They are signed with Ed25519, so
+// the signing key must be an Ed25519 key; tokens signed by other keys fail to verify.
+func NewPasetoCodec(keys KeyStore) Codec {
+	return &pasetoCodecImpl{keys: keys}
+}
+
+func (c *pasetoCodecImpl) Encode(payload *dto.TokenPayload) (string, error) {
+	key := c.keys.SigningKey()
+	signKey, err := ed25519SigningKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	claims := pasetoClaims{
+		Issuer:    payload.Issuer,
+		Subject:   payload.Subject,
+		Audience:  payload.Audience,
+		ExpiresAt: payload.ExpiresAt.UTC().Format(time.RFC3339),
+		IssuedAt:  payload.IssuedAt.UTC().Format(issuedAtLayout),
+		TokenId:   payload.TokenId,
+		UserId:    payload.UserId,
+		Role:      payload.Role,
+		SessionId: payload.SessionId,
+		Scope:     strings.Join(payload.Scopes, " "),
+		ClientId:  payload.ClientId,
+		TokenUse:  payload.TokenUse,
+		Purpose:   payload.Purpose,
+	}
+	if payload.ActorId != "" {
+		claims.Act = &dto.ActorClaim{Sub: payload.ActorId}
+	}
+
+	message, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	footer, err := json.Marshal(pasetoFooter{Kid: key.Id})
+	if err != nil {
+		return "", err
+	}
+
+	return signPaseto(signKey, message, footer), nil
+}
+
+func (c *pasetoCodecImpl) Decode(token string) (*dto.TokenPayload, error) {
+	message, footer, signature, err := splitPaseto(token)
+	if err != nil {
+		return nil, apperror.InvalidToken.Wrap(err)
+	}
+
+	keyFooter := pasetoFooter{}
+	if err := json.Unmarshal(footer, &keyFooter); err != nil {
+		return nil, apperror.InvalidToken.Wrap(err)
+	}
+
+	key, err := c.keys.VerificationKey(keyFooter.Kid)
+	if err != nil {
+		return nil, apperror.InvalidToken.Wrap(err)
+	}
+
+	verifyKey, ok := key.VerifyKey.(ed25519.PublicKey)
+	if !ok || !ed25519.Verify(verifyKey, pasetoPae([]byte(pasetoPublicHeader), message, footer, nil), signature) {
+		return nil, apperror.InvalidToken.Wrap(errors.New("signature is invalid"))
+	}
+
+	claims := pasetoClaims{}
+	if err := json.Unmarshal(message, &claims); err != nil {
+		return nil, apperror.InvalidToken.Wrap(err)
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, claims.ExpiresAt)
+	if err != nil {
+		return nil, apperror.InvalidToken.Wrap(errors.New("exp not found in payloads"))
+	}
+	if !time.Now().Before(expiresAt) {
+		return nil, apperror.TokenExpired
+	}
+
+	payload := &dto.TokenPayload{
+		Issuer:    claims.Issuer,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		TokenId:   claims.TokenId,
+		ExpiresAt: expiresAt,
+		UserId:    claims.UserId,
+		Role:      claims.Role,
+		SessionId: claims.SessionId,
+		Scopes:    strings.Fields(claims.Scope),
+		ClientId:  claims.ClientId,
+		TokenUse:  claims.TokenUse,
+		Purpose:   claims.Purpose,
+	}
+	if claims.IssuedAt != "" {
+		issuedAt, err := time.Parse(time.RFC3339, claims.IssuedAt)
+		if err != nil || issuedAt.After(time.Now()) {
+			return nil, apperror.InvalidToken.Wrap(errors.New("iat is invalid"))
+		}
+		payload.IssuedAt = issuedAt
+	}
+	if claims.Act != nil {
+		payload.ActorId = claims.Act.Sub
+	}
+
+	return payload, nil
+}
+
+func (c *pasetoCodecImpl) Handles(token string) bool {
+	return strings.HasPrefix(token, pasetoPublicHeader)
+}
+
+func ed25519SigningKey(key *Key) (ed25519.PrivateKey, error) {
+	signKey, ok := key.SignKey.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("PASETO v4.public needs an Ed25519 signing key, %s is %s", key.Id, key.Method.Alg()))
+	}
+
+	return signKey, nil
+}
+
+// signPaseto signs message and footer as specified for v4.public, with no implicit assertion.
+func signPaseto(key ed25519.PrivateKey, message []byte, footer []byte) string {
+	signature := ed25519.Sign(key, pasetoPae([]byte(pasetoPublicHeader), message, footer, nil))
+
+	token := pasetoPublicHeader + base64.RawURLEncoding.EncodeToString(append(message, signature...))
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+
+	return token
+}
+
+func splitPaseto(token string) (message []byte, footer []byte, signature []byte, err error) {
+	if !strings.HasPrefix(token, pasetoPublicHeader) {
+		return nil, nil, nil, errors.New("not a v4.public token")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, pasetoPublicHeader), ".")
+	if len(parts) > 2 {
+		return nil, nil, nil, errors.New("token is malformed")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(body) < ed25519.SignatureSize {
+		return nil, nil, nil, errors.New("token is too short")
+	}
+
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	split := len(body) - ed25519.SignatureSize
+	return body[:split], footer, body[split:], nil
+}
+
+// pasetoPae is the pre-authentication encoding: the number of pieces followed by each piece
+// prefixed with its length, all lengths as 64-bit little-endian integers.
+func pasetoPae(pieces ...[]byte) []byte {
+	encoded := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, piece := range pieces {
+		encoded = binary.LittleEndian.AppendUint64(encoded, uint64(len(piece)))
+		encoded = append(encoded, piece...)
+	}
+
+	return encoded
+}
@@ -2,57 +2,106 @@ package jwt
 
 import (
 	"fmt"
+	"slices"
 	"time"
 
-	_jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
 	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
-	"github.com/isd-sgcu/rpkm67-model/constant"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 type Service interface {
-	CreateToken(userId string, role constant.Role) (string, error)
-	ValidateToken(token string) (*_jwt.Token, error)
+	CreateToken(claims *dto.TokenClaims) (string, error)
+	CreateServiceToken(clientId string, tokenId string) (string, error)
+	CreateQrToken(userId string, purpose string, tokenId string) (string, error)
+	ValidateToken(token string, audience string) (*dto.TokenPayload, error)
 	GetConfig() *config.JwtConfig
 }
 
 type serviceImpl struct {
-	config   config.JwtConfig
-	strategy JwtStrategy
-	jwtUtils JwtUtils
-	log      *zap.Logger
+	config config.JwtConfig
+	codec  Codec
+	log    *zap.Logger
 }
 
-func NewService(config config.JwtConfig, strategy JwtStrategy, jwtUtils JwtUtils, log *zap.Logger) Service {
-	return &serviceImpl{config: config, strategy: strategy, jwtUtils: jwtUtils, log: log}
+func NewService(config config.JwtConfig, codec Codec, log *zap.Logger) Service {
+	return &serviceImpl{config: config, codec: codec, log: log}
 }
 
-func (s *serviceImpl) CreateToken(userId string, role constant.Role) (string, error) {
-	payloads := dto.AuthPayload{
-		RegisteredClaims: _jwt.RegisteredClaims{
-			Issuer:    s.config.Issuer,
-			ExpiresAt: s.jwtUtils.GetNumericDate(time.Now().Add(time.Second * time.Duration(s.config.AccessTTL))),
-			IssuedAt:  s.jwtUtils.GetNumericDate(time.Now()),
-		},
-		UserId: userId,
-		Role:   role,
+func (s *serviceImpl) CreateToken(claims *dto.TokenClaims) (string, error) {
+	ttl := claims.TTL
+	if ttl <= 0 {
+		ttl = s.config.AccessTTL
 	}
 
-	token := s.jwtUtils.GenerateJwtToken(_jwt.SigningMethodHS256, payloads)
+	return s.signToken(&dto.TokenPayload{
+		Issuer:    s.config.Issuer,
+		Audience:  claims.Audience,
+		TokenId:   claims.TokenId,
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(ttl)),
+		UserId:    claims.UserId,
+		Role:      claims.Role,
+		SessionId: claims.SessionId,
+		Scopes:    claims.Scopes,
+		ActorId:   claims.ActorId,
+	})
+}
+
+// CreateServiceToken signs a machine token for a service client. It has no user or session,
+// so it can never pass as a user's access token.
+func (s *serviceImpl) CreateServiceToken(clientId string, tokenId string) (string, error) {
+	return s.signToken(&dto.TokenPayload{
+		Issuer:    s.config.Issuer,
+		Subject:   clientId,
+		TokenId:   tokenId,
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(s.config.ServiceTokenTTL)),
+		ClientId:  clientId,
+		TokenUse:  dto.ServiceTokenUse,
+	})
+}
 
-	tokenStr, err := s.jwtUtils.SignedTokenString(token, s.config.Secret)
+// CreateQrToken signs a token that only proves who the user is for the given purpose. It
+// carries no role, session or scopes, so it is useless as an access token if photographed.
+func (s *serviceImpl) CreateQrToken(userId string, purpose string, tokenId string) (string, error) {
+	return s.signToken(&dto.TokenPayload{
+		Issuer:    s.config.Issuer,
+		Subject:   userId,
+		TokenId:   tokenId,
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(s.config.QrTokenTTL)),
+		UserId:    userId,
+		TokenUse:  dto.QrTokenUse,
+		Purpose:   purpose,
+	})
+}
+
+// ValidateToken checks the signature and expiry of the token and, when audience is given,
+// that the token was issued for it. Errors are apperror.TokenExpired or apperror.InvalidToken.
+func (s *serviceImpl) ValidateToken(token string, audience string) (*dto.TokenPayload, error) {
+	payload, err := s.codec.Decode(token)
 	if err != nil {
-		s.log.Named("CreateToken").Error("SignedTokenString: ", zap.Error(err))
-		return "", errors.New(fmt.Sprintf("Error while signing the token due to: %s", err.Error()))
+		return nil, err
 	}
 
-	return tokenStr, nil
+	if audience != "" && !slices.Contains(payload.Audience, audience) {
+		return nil, apperror.InvalidToken.Wrap(errors.New(fmt.Sprintf("token is not valid for audience %s", audience)))
+	}
+
+	return payload, nil
 }
 
-func (s *serviceImpl) ValidateToken(token string) (*_jwt.Token, error) {
-	return s.jwtUtils.ParseToken(token, s.strategy.AuthDecode)
+func (s *serviceImpl) signToken(payload *dto.TokenPayload) (string, error) {
+	tokenStr, err := s.codec.Encode(payload)
+	if err != nil {
+		s.log.Named("signToken").Error("Encode: ", zap.Error(err))
+		return "", errors.New(fmt.Sprintf("Error while signing the token due to: %s", err.Error()))
+	}
+
+	return tokenStr, nil
 }
 
 func (s *serviceImpl) GetConfig() *config.JwtConfig {
@@ -12,17 +12,24 @@ type JwtStrategy interface {
 }
 
 type jwtStrategyImpl struct {
-	secret string
+	keys KeyStore
 }
 
-func NewJwtStrategy(secret string) JwtStrategy {
-	return &jwtStrategyImpl{secret: secret}
+func NewJwtStrategy(keys KeyStore) JwtStrategy {
+	return &jwtStrategyImpl{keys: keys}
 }
 
 func (s *jwtStrategyImpl) AuthDecode(token *jwt.Token) (interface{}, error) {
-	if _, isValid := token.Method.(*jwt.SigningMethodHMAC); !isValid {
+	kid, _ := token.Header["kid"].(string)
+
+	key, err := s.keys.VerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
 		return nil, errors.New(fmt.Sprintf("invalid token %v\n", token.Header["alg"]))
 	}
 
-	return []byte(s.secret), nil
+	return key.VerifyKey, nil
 }
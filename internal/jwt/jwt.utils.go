@@ -6,11 +6,21 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// issuedAtLayout is RFC 3339 with milliseconds, the precision of iat in every token format.
+const issuedAtLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// iat has millisecond precision so that a token issued right after a user's sessions were
+// revoked is not taken for one issued before.
+func init() {
+	jwt.TimePrecision = time.Millisecond
+}
+
 type JwtUtils interface {
 	GenerateJwtToken(method jwt.SigningMethod, payloads jwt.Claims) *jwt.Token
 	GetNumericDate(time time.Time) *jwt.NumericDate
-	SignedTokenString(token *jwt.Token, secret string) (string, error)
+	SignedTokenString(token *jwt.Token, key interface{}) (string, error)
 	ParseToken(tokenStr string, keyFunc jwt.Keyfunc) (*jwt.Token, error)
+	ParseTokenWithClaims(tokenStr string, claims jwt.Claims, keyFunc jwt.Keyfunc) (*jwt.Token, error)
 }
 
 type jwtUtilImpl struct{}
@@ -27,10 +37,14 @@ func (u *jwtUtilImpl) GetNumericDate(time time.Time) *jwt.NumericDate {
 	return jwt.NewNumericDate(time)
 }
 
-func (u *jwtUtilImpl) SignedTokenString(token *jwt.Token, secret string) (string, error) {
-	return token.SignedString([]byte(secret))
+func (u *jwtUtilImpl) SignedTokenString(token *jwt.Token, key interface{}) (string, error) {
+	return token.SignedString(key)
 }
 
 func (u *jwtUtilImpl) ParseToken(tokenStr string, keyFunc jwt.Keyfunc) (*jwt.Token, error) {
 	return jwt.Parse(tokenStr, keyFunc)
 }
+
+func (u *jwtUtilImpl) ParseTokenWithClaims(tokenStr string, claims jwt.Claims, keyFunc jwt.Keyfunc) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenStr, claims, keyFunc)
+}
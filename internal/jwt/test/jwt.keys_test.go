@@ -0,0 +1,178 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyStoreTest struct {
+	suite.Suite
+	conf config.JwtConfig
+}
+
+func TestKeyStore(t *testing.T) {
+	suite.Run(t, new(KeyStoreTest))
+}
+
+func (t *KeyStoreTest) SetupTest() {
+	t.conf = config.JwtConfig{
+		Secret:  "secret",
+		KeysDir: t.T().TempDir(),
+	}
+}
+
+func (t *KeyStoreTest) writeKey(kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	t.Require().NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	t.Require().NoError(err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	t.Require().NoError(os.WriteFile(filepath.Join(t.conf.KeysDir, kid+".pem"), data, 0o600))
+}
+
+func (t *KeyStoreTest) newKeyStore() jwt.KeyStore {
+	keys, err := jwt.NewKeyStore(t.conf)
+	t.Require().NoError(err)
+
+	return keys
+}
+
+func (t *KeyStoreTest) manifest() *jwt.KeyManifest {
+	manifest, err := jwt.ReadKeyManifest(t.conf.KeysDir)
+	t.Require().NoError(err)
+
+	return manifest
+}
+
+func (t *KeyStoreTest) keyIds(keys []*jwt.Key) []string {
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, key.Id)
+	}
+
+	return ids
+}
+
+func (t *KeyStoreTest) TestSingleKeyIsActive() {
+	t.writeKey("only")
+	keys := t.newKeyStore()
+
+	t.Equal("only", keys.SigningKey().Id)
+	t.Equal(&jwt.KeyManifest{}, t.manifest())
+}
+
+func (t *KeyStoreTest) TestSeveralKeysNeedActiveKey() {
+	t.writeKey("first")
+	t.writeKey("second")
+
+	_, err := jwt.NewKeyStore(t.conf)
+	t.Error(err)
+
+	t.conf.SigningKeyId = "second"
+	t.Equal("second", t.newKeyStore().SigningKey().Id)
+}
+
+func (t *KeyStoreTest) TestActivate() {
+	t.writeKey("old")
+	keys := t.newKeyStore()
+
+	// a key added after start up is picked up by Activate
+	t.writeKey("new")
+	t.Require().NoError(keys.Activate("new"))
+
+	t.Equal("new", keys.SigningKey().Id)
+	t.Equal("new", t.manifest().Active)
+	t.ElementsMatch([]string{"old", "new"}, t.keyIds(keys.VerificationKeys()))
+
+	// another replica reads the same manifest
+	t.Equal("new", t.newKeyStore().SigningKey().Id)
+}
+
+func (t *KeyStoreTest) TestActivateUnknownKey() {
+	t.writeKey("only")
+	keys := t.newKeyStore()
+
+	t.Error(keys.Activate("missing"))
+	t.Equal("only", keys.SigningKey().Id)
+	t.Empty(t.manifest().Active)
+}
+
+func (t *KeyStoreTest) TestRetire() {
+	t.writeKey("old")
+	keys := t.newKeyStore()
+	t.writeKey("new")
+	t.Require().NoError(keys.Activate("new"))
+
+	t.Require().NoError(keys.Retire("old"))
+	// retiring twice is a no-op
+	t.Require().NoError(keys.Retire("old"))
+
+	t.Equal([]string{"old"}, t.manifest().Retired)
+	t.Equal([]string{"new"}, t.keyIds(keys.VerificationKeys()))
+
+	_, err := keys.VerificationKey("old")
+	t.Error(err)
+	_, err = keys.VerificationKey("new")
+	t.NoError(err)
+
+	// a retired key cannot sign again
+	t.Error(keys.Activate("old"))
+	t.Equal("new", keys.SigningKey().Id)
+}
+
+func (t *KeyStoreTest) TestRetireActiveKey() {
+	t.writeKey("only")
+	keys := t.newKeyStore()
+
+	t.Error(keys.Retire("only"))
+	t.Empty(t.manifest().Retired)
+}
+
+func (t *KeyStoreTest) TestRotationRequiresKeysDir() {
+	t.conf.KeysDir = ""
+	keys := t.newKeyStore()
+
+	t.Error(keys.Activate("default"))
+	t.Error(keys.Retire("default"))
+	t.Equal("default", keys.SigningKey().Id)
+}
+
+func (t *KeyStoreTest) TestManifestRoundTrip() {
+	manifest := &jwt.KeyManifest{Active: "new", Retired: []string{"old"}}
+	t.Require().NoError(jwt.WriteKeyManifest(t.conf.KeysDir, manifest))
+
+	t.Equal(manifest, t.manifest())
+
+	// the temporary file is renamed into place
+	entries, err := os.ReadDir(t.conf.KeysDir)
+	t.Require().NoError(err)
+	t.Len(entries, 1)
+	t.Equal("keys.json", entries[0].Name())
+}
+
+func (t *KeyStoreTest) TestInvalidManifest() {
+	t.writeKey("only")
+	t.Require().NoError(os.WriteFile(filepath.Join(t.conf.KeysDir, "keys.json"), []byte("{"), 0o600))
+
+	_, err := jwt.NewKeyStore(t.conf)
+	t.Error(err)
+}
+
+func (t *KeyStoreTest) TestManifestActiveKeyMissing() {
+	t.writeKey("only")
+	t.Require().NoError(jwt.WriteKeyManifest(t.conf.KeysDir, &jwt.KeyManifest{Active: "missing"}))
+
+	_, err := jwt.NewKeyStore(t.conf)
+	t.Error(err)
+}
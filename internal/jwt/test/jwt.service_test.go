@@ -0,0 +1,292 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type JwtServiceTest struct {
+	suite.Suite
+	conf   config.JwtConfig
+	claims *dto.TokenClaims
+	logger *zap.Logger
+}
+
+func TestJwtService(t *testing.T) {
+	suite.Run(t, new(JwtServiceTest))
+}
+
+func (t *JwtServiceTest) SetupTest() {
+	t.conf = config.JwtConfig{
+		Secret:     "secret",
+		AccessTTL:  3600,
+		RefreshTTL: 259200,
+		Issuer:     "issuer",
+	}
+	t.claims = &dto.TokenClaims{
+		UserId:    "user-id",
+		Role:      constant.USER,
+		SessionId: "session-id",
+		TokenId:   "token-id",
+	}
+	t.logger = zap.NewNop()
+}
+
+func (t *JwtServiceTest) newService(conf config.JwtConfig) (jwt.Service, jwt.KeyStore) {
+	keys, err := jwt.NewKeyStore(conf)
+	t.Require().NoError(err)
+
+	codec, err := jwt.NewCodec(conf.TokenFormat, keys, jwt.NewJwtStrategy(keys), jwt.NewJwtUtils())
+	t.Require().NoError(err)
+
+	return jwt.NewService(conf, codec, t.logger), keys
+}
+
+func (t *JwtServiceTest) parseHeader(tokenStr string) map[string]interface{} {
+	token, _, err := _jwt.NewParser().ParseUnverified(tokenStr, _jwt.MapClaims{})
+	t.Require().NoError(err)
+
+	return token.Header
+}
+
+func (t *JwtServiceTest) writeKey(dir string, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	t.Require().NoError(err)
+	t.writePrivateKey(dir, kid, key)
+}
+
+func (t *JwtServiceTest) writeEd25519Key(dir string, kid string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+	t.writePrivateKey(dir, kid, key)
+}
+
+func (t *JwtServiceTest) writePrivateKey(dir string, kid string, key interface{}) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	t.Require().NoError(err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	t.Require().NoError(os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600))
+}
+
+func (t *JwtServiceTest) TestCreateTokenHmacSuccess() {
+	svc, _ := t.newService(t.conf)
+
+	tokenStr, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+
+	payload, err := svc.ValidateToken(tokenStr, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", payload.UserId)
+	t.Equal("session-id", payload.SessionId)
+
+	header := t.parseHeader(tokenStr)
+	t.Equal("HS256", header["alg"])
+	t.Equal("default", header["kid"])
+}
+
+func (t *JwtServiceTest) TestRotateKeysSuccess() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.writeKey(t.conf.KeysDir, "old")
+	svc, keys := t.newService(t.conf)
+
+	oldToken, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+
+	t.writeKey(t.conf.KeysDir, "new")
+	t.Require().NoError(keys.Activate("new"))
+
+	newToken, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+
+	_, err = svc.ValidateToken(newToken, "")
+	t.Require().NoError(err)
+
+	header := t.parseHeader(newToken)
+	t.Equal("ES256", header["alg"])
+	t.Equal("new", header["kid"])
+
+	_, err = svc.ValidateToken(oldToken, "")
+	t.NoError(err)
+
+	t.Require().NoError(keys.Retire("old"))
+	_, err = svc.ValidateToken(oldToken, "")
+	t.Error(err)
+}
+
+func (t *JwtServiceTest) TestRetireActiveKeyFailed() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.writeKey(t.conf.KeysDir, "only")
+	_, keys := t.newService(t.conf)
+
+	t.Error(keys.Retire("only"))
+}
+
+func (t *JwtServiceTest) TestJwksHandlerSuccess() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.writeKey(t.conf.KeysDir, "kid")
+	_, keys := t.newService(t.conf)
+	handler := jwt.NewJwksHandler(keys, 300, t.logger)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, jwt.JwksPath, nil))
+	t.Equal(http.StatusOK, rec.Code)
+	t.Equal("public, max-age=300", rec.Header().Get("Cache-Control"))
+
+	jwks := &dto.JWKS{}
+	t.Require().NoError(json.Unmarshal(rec.Body.Bytes(), jwks))
+	t.Require().Len(jwks.Keys, 1)
+	t.Equal("kid", jwks.Keys[0].Kid)
+	t.Equal("EC", jwks.Keys[0].Kty)
+	t.Equal("P-256", jwks.Keys[0].Crv)
+
+	req := httptest.NewRequest(http.MethodGet, jwt.JwksPath, nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	t.Equal(http.StatusNotModified, rec.Code)
+}
+
+func (t *JwtServiceTest) TestJwksOmitsHmacSecret() {
+	_, keys := t.newService(t.conf)
+
+	t.Empty(jwt.BuildJwks(keys.VerificationKeys()).Keys)
+}
+
+func (t *JwtServiceTest) TestValidateTokenAudience() {
+	svc, _ := t.newService(t.conf)
+	t.claims.Audience = []string{"gateway"}
+
+	tokenStr, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+
+	_, err = svc.ValidateToken(tokenStr, "gateway")
+	t.NoError(err)
+
+	_, err = svc.ValidateToken(tokenStr, "checkin")
+	t.Error(err)
+}
+
+func (t *JwtServiceTest) TestCreateTokenImpersonation() {
+	svc, _ := t.newService(t.conf)
+	t.claims.ActorId = "staff-id"
+	t.claims.TTL = 60
+
+	tokenStr, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+
+	payload, err := svc.ValidateToken(tokenStr, "")
+	t.Require().NoError(err)
+
+	t.Equal("staff-id", payload.ActorId)
+	t.Equal(payload.IssuedAt.Add(60*time.Second), payload.ExpiresAt)
+}
+
+func (t *JwtServiceTest) TestCreateQrToken() {
+	t.conf.QrTokenTTL = 60
+	svc, _ := t.newService(t.conf)
+
+	tokenStr, err := svc.CreateQrToken("user-id", "checkin", "token-id")
+	t.Require().NoError(err)
+
+	payload, err := svc.ValidateToken(tokenStr, "")
+	t.Require().NoError(err)
+
+	t.Equal(dto.QrTokenUse, payload.TokenUse)
+	t.Equal("checkin", payload.Purpose)
+	t.Equal("user-id", payload.UserId)
+	t.Empty(payload.Role)
+}
+
+func (t *JwtServiceTest) TestCreateTokenPasetoSuccess() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.conf.TokenFormat = jwt.FormatPaseto
+	t.writeEd25519Key(t.conf.KeysDir, "ed")
+	svc, _ := t.newService(t.conf)
+	t.claims.Audience = []string{"gateway"}
+	t.claims.Scopes = []string{"user:read", "user:write"}
+
+	tokenStr, err := svc.CreateToken(t.claims)
+	t.Require().NoError(err)
+	t.True(strings.HasPrefix(tokenStr, "v4.public."))
+
+	payload, err := svc.ValidateToken(tokenStr, "gateway")
+	t.Require().NoError(err)
+	t.Equal("issuer", payload.Issuer)
+	t.Equal("user-id", payload.UserId)
+	t.Equal(constant.USER, payload.Role)
+	t.Equal("session-id", payload.SessionId)
+	t.Equal("token-id", payload.TokenId)
+	t.Equal([]string{"user:read", "user:write"}, payload.Scopes)
+
+	_, err = svc.ValidateToken(tokenStr, "checkin")
+	t.ErrorIs(err, apperror.InvalidToken)
+
+	_, err = svc.ValidateToken(strings.Replace(tokenStr, "v4.public.ey", "v4.public.ez", 1), "")
+	t.ErrorIs(err, apperror.InvalidToken)
+}
+
+func (t *JwtServiceTest) TestCreateTokenPasetoExpired() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.conf.TokenFormat = jwt.FormatPaseto
+	t.writeEd25519Key(t.conf.KeysDir, "ed")
+	svc, keys := t.newService(t.conf)
+
+	tokenStr, err := jwt.NewPasetoCodec(keys).Encode(&dto.TokenPayload{
+		Issuer:    "issuer",
+		UserId:    "user-id",
+		IssuedAt:  time.Now().Add(-time.Hour),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	})
+	t.Require().NoError(err)
+
+	_, err = svc.ValidateToken(tokenStr, "")
+	t.ErrorIs(err, apperror.TokenExpired)
+}
+
+func (t *JwtServiceTest) TestPasetoRequiresEd25519Key() {
+	t.conf.TokenFormat = jwt.FormatPaseto
+	keys, err := jwt.NewKeyStore(t.conf)
+	t.Require().NoError(err)
+
+	_, err = jwt.NewCodec(t.conf.TokenFormat, keys, jwt.NewJwtStrategy(keys), jwt.NewJwtUtils())
+	t.Error(err)
+}
+
+func (t *JwtServiceTest) TestSwitchTokenFormatKeepsOldTokens() {
+	t.conf.KeysDir = t.T().TempDir()
+	t.writeEd25519Key(t.conf.KeysDir, "ed")
+	jwtSvc, _ := t.newService(t.conf)
+
+	jwtToken, err := jwtSvc.CreateToken(t.claims)
+	t.Require().NoError(err)
+	t.Equal("EdDSA", t.parseHeader(jwtToken)["alg"])
+
+	t.conf.TokenFormat = jwt.FormatPaseto
+	pasetoSvc, _ := t.newService(t.conf)
+
+	payload, err := pasetoSvc.ValidateToken(jwtToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", payload.UserId)
+}
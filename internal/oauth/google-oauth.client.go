@@ -3,18 +3,20 @@ package oauth
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"io"
 	"net/http"
 	"net/url"
 
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
 	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 )
 
 type GoogleOauthClient interface {
-	GetUserEmail(code string) (string, error)
+	// GetUserEmail exchanges the code, proving with the PKCE code verifier that this service
+	// started the login, and returns the email of the Google account.
+	GetUserEmail(ctx context.Context, code string, codeVerifier string) (string, error)
 }
 
 type googleOauthClientImpl struct {
@@ -29,37 +31,30 @@ func NewGoogleOauthClient(oauthConfig *oauth2.Config, log *zap.Logger) GoogleOau
 	}
 }
 
-var (
-	InvalidCode   = errors.New("Invalid code")
-	HttpError     = errors.New("Unable to get user info")
-	IOError       = errors.New("Unable to read google response")
-	InvalidFormat = errors.New("Google sent unexpected format")
-)
-
-func (c *googleOauthClientImpl) GetUserEmail(code string) (string, error) {
-	token, err := c.oauthConfig.Exchange(context.TODO(), code)
+func (c *googleOauthClientImpl) GetUserEmail(ctx context.Context, code string, codeVerifier string) (string, error) {
+	token, err := c.oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
 	if err != nil {
 		c.log.Named("GetUserEmail").Error("Exchange: ", zap.Error(err))
-		return "", InvalidCode
+		return "", apperror.InvalidCode.Wrap(err)
 	}
 
 	resp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + url.QueryEscape(token.AccessToken))
 	if err != nil {
 		c.log.Named("GetUserEmail").Error("Get: ", zap.Error(err))
-		return "", HttpError
+		return "", apperror.OauthUnavailable.Wrap(err)
 	}
 	defer resp.Body.Close()
 
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
 		c.log.Named("GetUserEmail").Error("ReadAll: ", zap.Error(err))
-		return "", IOError
+		return "", apperror.OauthUnavailable.Wrap(err)
 	}
 
 	var parsedResponse dto.GoogleUserEmailResponse
 	if err = json.Unmarshal(response, &parsedResponse); err != nil {
 		c.log.Named("GetUserEmail").Error("Unmarshal: ", zap.Error(err))
-		return "", InvalidFormat
+		return "", apperror.OauthUnavailable.Wrap(err)
 	}
 
 	return parsedResponse.Email, nil
@@ -0,0 +1,105 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// StateStore keeps the state and PKCE code verifier of every Google login attempt, so that a
+// callback is only accepted for a login this service started, only once, and only from the
+// browser that started it.
+type StateStore interface {
+	// Create starts a login attempt bound to the browser holding binding, and returns its
+	// state with the code verifier to derive the code challenge from.
+	Create(ctx context.Context, binding string) (state string, attempt *dto.OauthLoginAttempt, err error)
+	// Consume ends the login attempt with the given state and returns it. It fails with
+	// InvalidState for a state that is unknown, expired, already used or bound to another
+	// browser.
+	Consume(ctx context.Context, state string, binding string) (*dto.OauthLoginAttempt, error)
+}
+
+type stateStoreImpl struct {
+	cache cache.Repository
+	ttl   int
+}
+
+// NewStateStore keeps login attempts in the cache for ttl seconds, which is how long a user
+// has to sign in with Google.
+func NewStateStore(cache cache.Repository, ttl int) StateStore {
+	return &stateStoreImpl{
+		cache: cache,
+		ttl:   ttl,
+	}
+}
+
+func (s *stateStoreImpl) Create(ctx context.Context, binding string) (string, *dto.OauthLoginAttempt, error) {
+	if binding == "" {
+		return "", nil, apperror.MissingOauthBinding
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+
+	attempt := &dto.OauthLoginAttempt{
+		CodeVerifier: oauth2.GenerateVerifier(),
+		BindingHash:  hashBinding(binding),
+		CreatedAt:    time.Now(),
+	}
+
+	if err := s.cache.SetValue(ctx, stateKey(state), attempt, s.ttl); err != nil {
+		return "", nil, err
+	}
+
+	return state, attempt, nil
+}
+
+func (s *stateStoreImpl) Consume(ctx context.Context, state string, binding string) (*dto.OauthLoginAttempt, error) {
+	if binding == "" {
+		return nil, apperror.MissingOauthBinding
+	}
+	if state == "" {
+		return nil, apperror.InvalidState
+	}
+
+	// taken in one step, so a replayed callback finds nothing
+	attempt := &dto.OauthLoginAttempt{}
+	err := s.cache.GetDelValue(ctx, stateKey(state), attempt)
+	if errors.Is(err, redis.Nil) {
+		return nil, apperror.InvalidState
+	} else if err != nil {
+		return nil, err
+	}
+
+	// a state handed to another browser, e.g. in a link planted by an attacker signing the
+	// victim into the attacker's account, is used up without signing anyone in
+	if subtle.ConstantTimeCompare([]byte(attempt.BindingHash), []byte(hashBinding(binding))) != 1 {
+		return nil, apperror.InvalidState
+	}
+
+	return attempt, nil
+}
+
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+func stateKey(state string) string {
+	return fmt.Sprintf("oauth:state:%s", state)
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/oauth"
+	"github.com/stretchr/testify/suite"
+)
+
+type StateStoreTest struct {
+	suite.Suite
+	states oauth.StateStore
+	ctx    context.Context
+}
+
+func TestStateStore(t *testing.T) {
+	suite.Run(t, new(StateStoreTest))
+}
+
+func (t *StateStoreTest) SetupTest() {
+	t.states = oauth.NewStateStore(cache.NewMemoryRepository(cache.Options{}), 1)
+	t.ctx = context.Background()
+}
+
+func (t *StateStoreTest) TestConsumeOnce() {
+	state, attempt, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+	t.Len(state, 43)
+	t.Len(attempt.CodeVerifier, 43)
+
+	consumed, err := t.states.Consume(t.ctx, state, "binding")
+	t.Require().NoError(err)
+	t.Equal(attempt.CodeVerifier, consumed.CodeVerifier)
+
+	_, err = t.states.Consume(t.ctx, state, "binding")
+	t.ErrorIs(err, apperror.InvalidState)
+}
+
+func (t *StateStoreTest) TestStatesDiffer() {
+	first, firstAttempt, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+	second, secondAttempt, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+
+	t.NotEqual(first, second)
+	t.NotEqual(firstAttempt.CodeVerifier, secondAttempt.CodeVerifier)
+}
+
+func (t *StateStoreTest) TestConsumeUnknown() {
+	_, err := t.states.Consume(t.ctx, "", "binding")
+	t.ErrorIs(err, apperror.InvalidState)
+
+	_, err = t.states.Consume(t.ctx, "forged", "binding")
+	t.ErrorIs(err, apperror.InvalidState)
+}
+
+func (t *StateStoreTest) TestConsumeExpired() {
+	state, _, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = t.states.Consume(t.ctx, state, "binding")
+	t.ErrorIs(err, apperror.InvalidState)
+}
+
+func (t *StateStoreTest) TestConsumeFromAnotherBrowser() {
+	state, _, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+
+	_, err = t.states.Consume(t.ctx, state, "other-binding")
+	t.ErrorIs(err, apperror.InvalidState)
+
+	// the attempt is used up, so the state cannot be tried again
+	_, err = t.states.Consume(t.ctx, state, "binding")
+	t.ErrorIs(err, apperror.InvalidState)
+}
+
+func (t *StateStoreTest) TestMissingBinding() {
+	_, _, err := t.states.Create(t.ctx, "")
+	t.ErrorIs(err, apperror.MissingOauthBinding)
+
+	state, _, err := t.states.Create(t.ctx, "binding")
+	t.Require().NoError(err)
+
+	_, err = t.states.Consume(t.ctx, state, "")
+	t.ErrorIs(err, apperror.MissingOauthBinding)
+
+	// the attempt is left for the browser that holds the binding
+	_, err = t.states.Consume(t.ctx, state, "binding")
+	t.NoError(err)
+}
@@ -0,0 +1,20 @@
+package permission
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+)
+
+type RolePermission struct {
+	Role       constant.Role `json:"role" gorm:"primaryKey;type:text"`
+	Permission string        `json:"permission" gorm:"primaryKey;type:text"`
+	CreatedAt  time.Time     `json:"created_at" gorm:"type:timestamp;autoCreateTime"`
+}
+
+type UserPermission struct {
+	UserID     uuid.UUID `json:"user_id" gorm:"primaryKey;type:uuid"`
+	Permission string    `json:"permission" gorm:"primaryKey;type:text"`
+	CreatedAt  time.Time `json:"created_at" gorm:"type:timestamp;autoCreateTime"`
+}
@@ -0,0 +1,48 @@
+package permission
+
+import (
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Repository interface {
+	FindByRole(role constant.Role, permissions *[]RolePermission) error
+	FindByUser(userId string, permissions *[]UserPermission) error
+	CreateRolePermission(permission *RolePermission) error
+	DeleteRolePermission(role constant.Role, permission string) error
+	CreateUserPermission(permission *UserPermission) error
+	DeleteUserPermission(userId string, permission string) error
+}
+
+type repositoryImpl struct {
+	Db *gorm.DB
+}
+
+func NewRepository(db *gorm.DB) Repository {
+	return &repositoryImpl{Db: db}
+}
+
+func (r *repositoryImpl) FindByRole(role constant.Role, permissions *[]RolePermission) error {
+	return r.Db.Where("role = ?", role).Find(permissions).Error
+}
+
+func (r *repositoryImpl) FindByUser(userId string, permissions *[]UserPermission) error {
+	return r.Db.Where("user_id = ?", userId).Find(permissions).Error
+}
+
+func (r *repositoryImpl) CreateRolePermission(permission *RolePermission) error {
+	return r.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(permission).Error
+}
+
+func (r *repositoryImpl) DeleteRolePermission(role constant.Role, permission string) error {
+	return r.Db.Where("role = ? AND permission = ?", role, permission).Delete(&RolePermission{}).Error
+}
+
+func (r *repositoryImpl) CreateUserPermission(permission *UserPermission) error {
+	return r.Db.Clauses(clause.OnConflict{DoNothing: true}).Create(permission).Error
+}
+
+func (r *repositoryImpl) DeleteUserPermission(userId string, permission string) error {
+	return r.Db.Where("user_id = ? AND permission = ?", userId, permission).Delete(&UserPermission{}).Error
+}
@@ -0,0 +1,157 @@
+package permission
+
+import (
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"go.uber.org/zap"
+)
+
+// ManagePermissions allows granting and revoking permissions. Users listed in
+// AUTH_ADMIN_USER_IDS always have it, so permissions can be bootstrapped.
+const ManagePermissions = "permission:manage"
+
+// ImpersonateUsers allows obtaining a short-lived token that acts as another user.
+const ImpersonateUsers = "user:impersonate"
+
+var permissionPattern = regexp.MustCompile(`^[a-z][a-z_]*(:[a-z_]+)+$`)
+
+type Service interface {
+	// GetPermissions returns the permissions of the user's role together with the ones
+	// granted to the user directly.
+	GetPermissions(userId string, role constant.Role) ([]string, error)
+	ListRolePermissions(role constant.Role) ([]string, error)
+	ListUserPermissions(userId string) ([]string, error)
+	GrantRolePermission(role constant.Role, permission string) error
+	RevokeRolePermission(role constant.Role, permission string) error
+	GrantUserPermission(userId string, permission string) error
+	RevokeUserPermission(userId string, permission string) error
+}
+
+type serviceImpl struct {
+	conf *config.AuthConfig
+	repo Repository
+	log  *zap.Logger
+}
+
+func NewService(conf *config.AuthConfig, repo Repository, log *zap.Logger) Service {
+	return &serviceImpl{
+		conf: conf,
+		repo: repo,
+		log:  log,
+	}
+}
+
+func (s *serviceImpl) GetPermissions(userId string, role constant.Role) ([]string, error) {
+	rolePermissions, err := s.ListRolePermissions(role)
+	if err != nil {
+		s.log.Named("GetPermissions").Error("ListRolePermissions: ", zap.Error(err))
+		return nil, err
+	}
+
+	userPermissions, err := s.ListUserPermissions(userId)
+	if err != nil {
+		s.log.Named("GetPermissions").Error("ListUserPermissions: ", zap.Error(err))
+		return nil, err
+	}
+
+	permissions := append(rolePermissions, userPermissions...)
+	if slices.Contains(s.conf.AdminUserIds, userId) {
+		permissions = append(permissions, ManagePermissions)
+	}
+
+	sort.Strings(permissions)
+	return slices.Compact(permissions), nil
+}
+
+func (s *serviceImpl) ListRolePermissions(role constant.Role) ([]string, error) {
+	rolePermissions := []RolePermission{}
+	if err := s.repo.FindByRole(role, &rolePermissions); err != nil {
+		s.log.Named("ListRolePermissions").Error("FindByRole: ", zap.Error(err))
+		return nil, err
+	}
+
+	permissions := make([]string, 0, len(rolePermissions))
+	for _, p := range rolePermissions {
+		permissions = append(permissions, p.Permission)
+	}
+
+	return permissions, nil
+}
+
+func (s *serviceImpl) ListUserPermissions(userId string) ([]string, error) {
+	userPermissions := []UserPermission{}
+	if err := s.repo.FindByUser(userId, &userPermissions); err != nil {
+		s.log.Named("ListUserPermissions").Error("FindByUser: ", zap.Error(err))
+		return nil, err
+	}
+
+	permissions := make([]string, 0, len(userPermissions))
+	for _, p := range userPermissions {
+		permissions = append(permissions, p.Permission)
+	}
+
+	return permissions, nil
+}
+
+func (s *serviceImpl) GrantRolePermission(role constant.Role, permission string) error {
+	if !permissionPattern.MatchString(permission) {
+		return apperror.InvalidPermission
+	}
+
+	err := s.repo.CreateRolePermission(&RolePermission{Role: role, Permission: permission})
+	if err != nil {
+		s.log.Named("GrantRolePermission").Error("CreateRolePermission: ", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) RevokeRolePermission(role constant.Role, permission string) error {
+	err := s.repo.DeleteRolePermission(role, permission)
+	if err != nil {
+		s.log.Named("RevokeRolePermission").Error("DeleteRolePermission: ", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) GrantUserPermission(userId string, permission string) error {
+	if !permissionPattern.MatchString(permission) {
+		return apperror.InvalidPermission
+	}
+
+	id, err := uuid.Parse(userId)
+	if err != nil {
+		return apperror.InvalidUserId.Wrap(err)
+	}
+
+	err = s.repo.CreateUserPermission(&UserPermission{UserID: id, Permission: permission})
+	if err != nil {
+		s.log.Named("GrantUserPermission").Error("CreateUserPermission: ", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) RevokeUserPermission(userId string, permission string) error {
+	if _, err := uuid.Parse(userId); err != nil {
+		return apperror.InvalidUserId.Wrap(err)
+	}
+
+	err := s.repo.DeleteUserPermission(userId, permission)
+	if err != nil {
+		s.log.Named("RevokeUserPermission").Error("DeleteUserPermission: ", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
+	mock_permission "github.com/isd-sgcu/rpkm67-auth/mocks/permission"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type PermissionServiceTest struct {
+	suite.Suite
+	controller *gomock.Controller
+	repo       *mock_permission.MockRepository
+	conf       *config.AuthConfig
+	logger     *zap.Logger
+}
+
+func TestPermissionService(t *testing.T) {
+	suite.Run(t, new(PermissionServiceTest))
+}
+
+func (t *PermissionServiceTest) SetupTest() {
+	t.controller = gomock.NewController(t.T())
+	t.repo = mock_permission.NewMockRepository(t.controller)
+	t.conf = &config.AuthConfig{AdminUserIds: []string{"admin-id"}}
+	t.logger = zap.NewNop()
+}
+
+func (t *PermissionServiceTest) TestGetPermissionsSuccess() {
+	svc := permission.NewService(t.conf, t.repo, t.logger)
+
+	t.repo.EXPECT().FindByRole(constant.STAFF, gomock.Any()).SetArg(1, []permission.RolePermission{
+		{Role: constant.STAFF, Permission: "checkin:write"},
+		{Role: constant.STAFF, Permission: "stamp:award"},
+	}).Return(nil)
+	t.repo.EXPECT().FindByUser("user-id", gomock.Any()).SetArg(1, []permission.UserPermission{
+		{Permission: "stamp:award"},
+		{Permission: "user:read:medical"},
+	}).Return(nil)
+
+	permissions, err := svc.GetPermissions("user-id", constant.STAFF)
+
+	t.NoError(err)
+	t.Equal([]string{"checkin:write", "stamp:award", "user:read:medical"}, permissions)
+}
+
+func (t *PermissionServiceTest) TestGetPermissionsAdmin() {
+	svc := permission.NewService(t.conf, t.repo, t.logger)
+
+	t.repo.EXPECT().FindByRole(constant.USER, gomock.Any()).Return(nil)
+	t.repo.EXPECT().FindByUser("admin-id", gomock.Any()).Return(nil)
+
+	permissions, err := svc.GetPermissions("admin-id", constant.USER)
+
+	t.NoError(err)
+	t.Equal([]string{permission.ManagePermissions}, permissions)
+}
+
+func (t *PermissionServiceTest) TestGrantRolePermissionInvalid() {
+	svc := permission.NewService(t.conf, t.repo, t.logger)
+
+	err := svc.GrantRolePermission(constant.STAFF, "Check In")
+
+	t.ErrorIs(err, apperror.InvalidPermission)
+}
+
+func (t *PermissionServiceTest) TestUserPermissionInvalidUserId() {
+	svc := permission.NewService(t.conf, t.repo, t.logger)
+
+	t.ErrorIs(svc.GrantUserPermission("user-id", "stamp:award"), apperror.InvalidUserId)
+	t.ErrorIs(svc.RevokeUserPermission("user-id", "stamp:award"), apperror.InvalidUserId)
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+)
+
+type RevocationListTest struct {
+	suite.Suite
+	cache       cache.Repository
+	revocations token.RevocationList
+	ctx         context.Context
+}
+
+func TestRevocationList(t *testing.T) {
+	suite.Run(t, new(RevocationListTest))
+}
+
+func (t *RevocationListTest) SetupTest() {
+	t.cache = cache.NewMemoryRepository(cache.Options{})
+	t.revocations = token.NewRevocationList(t.cache, 60, zap.NewNop())
+	t.ctx = context.Background()
+}
+
+func (t *RevocationListTest) TestRevokeUserToTheMillisecond() {
+	before := time.Now()
+	t.Require().NoError(t.revocations.RevokeUser(t.ctx, "user-id", before))
+
+	t.True(t.revocations.IsRevoked("", "user-id", "", before.Add(-time.Millisecond)))
+	t.True(t.revocations.IsRevoked("", "user-id", "", before))
+	t.False(t.revocations.IsRevoked("", "user-id", "", before.Add(time.Millisecond)))
+	t.False(t.revocations.IsRevoked("", "other-id", "", before))
+}
+
+func (t *RevocationListTest) TestPruneOnWrite() {
+	expired := time.Now().Add(-time.Minute)
+	t.Require().NoError(t.revocations.RevokeToken(t.ctx, "expired", expired))
+	t.Require().NoError(t.revocations.RevokeUser(t.ctx, "expired", expired.Add(-time.Hour)))
+
+	for i := 0; i < 98; i++ {
+		t.Require().NoError(t.revocations.RevokeToken(t.ctx, fmt.Sprintf("token-%d", i), time.Now().Add(time.Minute)))
+	}
+
+	tokens, err := t.cache.GetFields(t.ctx, "revoked:tokens")
+	t.Require().NoError(err)
+	t.Len(tokens, 98)
+	t.NotContains(tokens, "expired")
+
+	users, err := t.cache.GetFields(t.ctx, "revoked:users")
+	t.Require().NoError(err)
+	t.Empty(users)
+
+	t.False(t.revocations.IsRevoked("expired", "", "", time.Now()))
+	t.True(t.revocations.IsRevoked("token-0", "", "", time.Now()))
+}
+
+func (t *RevocationListTest) TestRevokeRole() {
+	before := time.Now()
+	t.Require().NoError(t.revocations.RevokeRole(t.ctx, constant.STAFF, before))
+
+	t.True(t.revocations.IsRevoked("", "user-id", constant.STAFF, before))
+	t.False(t.revocations.IsRevoked("", "user-id", constant.STAFF, before.Add(time.Millisecond)))
+	t.False(t.revocations.IsRevoked("", "user-id", constant.USER, before))
+	t.False(t.revocations.IsRevoked("", "user-id", "", before))
+
+	// another replica learns about it on its next sync
+	other := token.NewRevocationList(t.cache, 60, zap.NewNop())
+	t.Require().NoError(other.Sync(t.ctx))
+	t.True(other.IsRevoked("", "user-id", constant.STAFF, before))
+}
@@ -0,0 +1,774 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	mock_permission "github.com/isd-sgcu/rpkm67-auth/mocks/permission"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TokenServiceTest runs the token lifecycle against the in-memory cache.
+type TokenServiceTest struct {
+	suite.Suite
+	controller *gomock.Controller
+	conf       config.JwtConfig
+	cache      cache.Repository
+	ctx        context.Context
+	client     *dto.ClientInfo
+	logger     *zap.Logger
+	// revocations is the list of the service last built by newService
+	revocations token.RevocationList
+}
+
+func TestTokenService(t *testing.T) {
+	suite.Run(t, new(TokenServiceTest))
+}
+
+func (t *TokenServiceTest) SetupTest() {
+	t.controller = gomock.NewController(t.T())
+	t.conf = config.JwtConfig{
+		Secret:             "secret",
+		AccessTTL:          3600,
+		RefreshTTL:         259200,
+		Issuer:             "issuer",
+		QrTokenTTL:         60,
+		RefreshGracePeriod: 10,
+	}
+	t.cache = cache.NewMemoryRepository(cache.Options{})
+	t.ctx = context.Background()
+	t.client = &dto.ClientInfo{Device: "device", ClientId: "client"}
+	t.logger = zap.NewNop()
+}
+
+// unavailableCache fails every read and write as an unreachable redis would while down is set.
+type unavailableCache struct {
+	cache.Repository
+	down bool
+}
+
+func (c *unavailableCache) err() error {
+	if c.down {
+		return apperror.CacheUnavailable.Wrap(context.DeadlineExceeded)
+	}
+	return nil
+}
+
+func (c *unavailableCache) GetValue(ctx context.Context, key string, value interface{}) error {
+	if err := c.err(); err != nil {
+		return err
+	}
+	return c.Repository.GetValue(ctx, key, value)
+}
+
+func (c *unavailableCache) GetValues(ctx context.Context, keys []string, values []interface{}) ([]bool, error) {
+	if err := c.err(); err != nil {
+		return nil, err
+	}
+	return c.Repository.GetValues(ctx, keys, values)
+}
+
+func (c *unavailableCache) SetValues(ctx context.Context, entries ...cache.Entry) error {
+	if err := c.err(); err != nil {
+		return err
+	}
+	return c.Repository.SetValues(ctx, entries...)
+}
+
+func (t *TokenServiceTest) newService() token.Service {
+	keys, err := jwt.NewKeyStore(t.conf)
+	t.Require().NoError(err)
+	codec, err := jwt.NewCodec(t.conf.TokenFormat, keys, jwt.NewJwtStrategy(keys), jwt.NewJwtUtils())
+	t.Require().NoError(err)
+
+	repo := mock_permission.NewMockRepository(t.controller)
+	repo.EXPECT().FindByRole(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	repo.EXPECT().FindByUser(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	t.revocations = token.NewRevocationList(t.cache, t.conf.RevocationRetention(), t.logger)
+
+	return token.NewService(
+		jwt.NewService(t.conf, codec, t.logger),
+		permission.NewService(&config.AuthConfig{}, repo, t.logger),
+		t.cache,
+		t.revocations,
+		token.NewValidationCache(0, 0),
+		token.NewTokenUtils(),
+		t.logger,
+	)
+}
+
+func (t *TokenServiceTest) TestTokenLifecycle() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", userCredentials.UserID)
+	t.Equal(constant.USER, userCredentials.Role)
+
+	refreshed, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.Require().NoError(err)
+	t.NotEqual(credentials.RefreshToken, refreshed.RefreshToken)
+
+	_, err = svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = svc.ValidateToken(t.ctx, refreshed.AccessToken, "")
+	t.Require().NoError(err)
+
+	t.Require().NoError(svc.RevokeSession(t.ctx, userCredentials.SessionID))
+
+	_, err = svc.ValidateToken(t.ctx, refreshed.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = svc.RefreshToken(t.ctx, refreshed.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+}
+
+func (t *TokenServiceTest) TestCancelledContext() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	cancel()
+
+	_, err = svc.CreateCredentials(ctx, "user-id", constant.USER, t.client)
+	t.ErrorIs(err, context.Canceled)
+	_, err = svc.ValidateToken(ctx, credentials.AccessToken, "")
+	t.ErrorIs(err, context.Canceled)
+	_, err = svc.RefreshToken(ctx, credentials.RefreshToken)
+	t.ErrorIs(err, context.Canceled)
+	t.Equal(codes.Canceled, status.Code(apperror.ToStatus(err)))
+
+	// the refresh token was not used up by the cancelled call
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestExpiredDeadline() {
+	svc := t.newService()
+
+	ctx, cancel := context.WithDeadline(t.ctx, time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := svc.CreateCredentials(ctx, "user-id", constant.USER, t.client)
+	t.ErrorIs(err, context.DeadlineExceeded)
+	t.Equal(codes.DeadlineExceeded, status.Code(apperror.ToStatus(err)))
+}
+
+func (t *TokenServiceTest) TestSessionPerDevice() {
+	svc := t.newService()
+
+	phone, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, &dto.ClientInfo{Device: "phone"})
+	t.Require().NoError(err)
+	laptop, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, &dto.ClientInfo{Device: "laptop"})
+	t.Require().NoError(err)
+
+	phoneCredentials, err := svc.ValidateToken(t.ctx, phone.AccessToken, "")
+	t.Require().NoError(err)
+	laptopCredentials, err := svc.ValidateToken(t.ctx, laptop.AccessToken, "")
+	t.Require().NoError(err)
+	t.NotEqual(phoneCredentials.SessionID, laptopCredentials.SessionID)
+
+	// logging in on the laptop left the phone signed in; signing the phone out leaves the laptop
+	t.Require().NoError(svc.RevokeSession(t.ctx, phoneCredentials.SessionID))
+
+	_, err = svc.ValidateToken(t.ctx, phone.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = svc.RefreshToken(t.ctx, phone.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+
+	_, err = svc.ValidateToken(t.ctx, laptop.AccessToken, "")
+	t.NoError(err)
+	_, err = svc.RefreshToken(t.ctx, laptop.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestTokenLifecycleBinaryCodec() {
+	t.cache = cache.NewMemoryRepository(cache.Options{KeyPrefix: "rpkm67:test:", Binary: true})
+
+	t.TestTokenLifecycle()
+}
+
+func (t *TokenServiceTest) TestCacheUnavailable() {
+	unavailable := &unavailableCache{Repository: t.cache}
+	t.cache = unavailable
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	unavailable.down = true
+
+	_, err = svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.ErrorIs(err, apperror.CacheUnavailable)
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.CacheUnavailable)
+	_, err = svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.ErrorIs(err, apperror.CacheUnavailable)
+}
+
+func (t *TokenServiceTest) TestCacheUnavailableSignatureOnly() {
+	t.conf.DegradedPolicy = "signature"
+	unavailable := &unavailableCache{Repository: t.cache}
+	t.cache = unavailable
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	revoked, err := svc.CreateCredentials(t.ctx, "revoked-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	t.Require().NoError(svc.RevokeAllSessions(t.ctx, "revoked-id"))
+
+	unavailable.down = true
+
+	userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", userCredentials.UserID)
+
+	// the revocation list is still checked
+	_, err = svc.ValidateToken(t.ctx, revoked.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+
+	// new logins and refreshes are refused
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.CacheUnavailable)
+	_, err = svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.ErrorIs(err, apperror.CacheUnavailable)
+
+	// once the cache is back the session is checked again
+	unavailable.down = false
+	t.Require().NoError(svc.RevokeSession(t.ctx, userCredentials.SessionID))
+	_, err = svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenDuplicateWithinGracePeriod() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	first, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.Require().NoError(err)
+	second, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.Require().NoError(err)
+
+	t.Equal(first, second)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenConcurrentWithinGracePeriod() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	refreshed := make([]*dto.Credentials, 5)
+	errs := make([]error, len(refreshed))
+	var wg sync.WaitGroup
+	for i := range refreshed {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			refreshed[i], errs[i] = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+		}(i)
+	}
+	wg.Wait()
+
+	// whichever refresh rotated the token, every tab ends up with its pair
+	for i := range refreshed {
+		t.Require().NoError(errs[i])
+		t.Equal(refreshed[0], refreshed[i])
+	}
+	_, err = svc.ValidateToken(t.ctx, refreshed[0].AccessToken, "")
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenDuplicateAfterGracePeriod() {
+	t.conf.RefreshGracePeriod = 1
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	refreshed, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.Require().NoError(err)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenReused)
+
+	_, err = svc.ValidateToken(t.ctx, refreshed.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenHashKeyChange() {
+	t.conf.RefreshTokenHashKey = "old-key"
+	credentials, err := t.newService().CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	t.conf.RefreshTokenHashKey = "new-key"
+	_, err = t.newService().RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenReused() {
+	t.conf.RefreshGracePeriod = 0
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	refreshed, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.Require().NoError(err)
+
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenReused)
+
+	// the whole family is revoked, including the pair handed out by the legitimate refresh
+	_, err = svc.ValidateToken(t.ctx, refreshed.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = svc.RefreshToken(t.ctx, refreshed.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+}
+
+func (t *TokenServiceTest) TestRefreshTokenReusedLeavesOtherSessions() {
+	t.conf.RefreshGracePeriod = 0
+	svc := t.newService()
+
+	stolen, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	other, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	_, err = svc.RefreshToken(t.ctx, stolen.RefreshToken)
+	t.Require().NoError(err)
+	_, err = svc.RefreshToken(t.ctx, stolen.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenReused)
+
+	// a replay keeps being reported after the family is gone
+	_, err = svc.RefreshToken(t.ctx, stolen.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenReused)
+
+	_, err = svc.ValidateToken(t.ctx, other.AccessToken, "")
+	t.NoError(err)
+	_, err = svc.RefreshToken(t.ctx, other.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestRevokeAllSessions() {
+	svc := t.newService()
+
+	phone, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	laptop, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	other, err := svc.CreateCredentials(t.ctx, "other-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	t.Require().NoError(svc.RevokeAllSessions(t.ctx, "user-id"))
+
+	for _, credentials := range []*dto.Credentials{phone, laptop} {
+		_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+		t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	}
+
+	_, err = svc.ValidateToken(t.ctx, other.AccessToken, "")
+	t.NoError(err)
+}
+
+// slowCache delays reads of hashes, widening the window between reading the session index and
+// writing it.
+type slowCache struct {
+	cache.Repository
+}
+
+func (c *slowCache) GetFields(ctx context.Context, key string) (map[string]string, error) {
+	time.Sleep(2 * time.Millisecond)
+	return c.Repository.GetFields(ctx, key)
+}
+
+func (t *TokenServiceTest) TestRevokeAllSessionsAfterConcurrentLogins() {
+	t.cache = &slowCache{Repository: t.cache}
+	svc := t.newService()
+
+	logins := make([]*dto.Credentials, 30)
+	errs := make([]error, len(logins))
+	var wg sync.WaitGroup
+	for i := range logins {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			logins[i], errs[i] = svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+		}(i)
+	}
+	wg.Wait()
+
+	sessions, err := t.cache.GetFields(t.ctx, "sessions:user-id")
+	t.Require().NoError(err)
+	t.Len(sessions, len(logins))
+
+	t.Require().NoError(svc.RevokeAllSessions(t.ctx, "user-id"))
+
+	for i, credentials := range logins {
+		t.Require().NoError(errs[i])
+		_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+		t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	}
+}
+
+func (t *TokenServiceTest) TestSessionIndexDropsExpiredSessions() {
+	t.conf.SessionMaxAge = 1
+	svc := t.newService()
+
+	_, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	sessions, err := t.cache.GetFields(t.ctx, "sessions:user-id")
+	t.Require().NoError(err)
+	t.Len(sessions, 1)
+}
+
+func (t *TokenServiceTest) TestLoginRightAfterRevokeAllSessions() {
+	t.conf.ValidationMode = "stateless"
+	svc := t.newService()
+
+	before, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	t.Require().NoError(svc.RevokeAllSessions(t.ctx, "user-id"))
+	// well within the second the sessions were revoked in
+	time.Sleep(2 * time.Millisecond)
+
+	after, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	_, err = svc.ValidateToken(t.ctx, before.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = svc.ValidateToken(t.ctx, after.AccessToken, "")
+	t.NoError(err)
+
+	_, err = svc.RefreshToken(t.ctx, after.RefreshToken)
+	t.NoError(err)
+}
+
+// ended reports whether a refresh failed because the session is over: once its refresh token
+// has expired from the cache, or in the last second of its TTL, when it is still there.
+func (t *TokenServiceTest) ended(err error) bool {
+	return errors.Is(err, apperror.RefreshTokenNotFound) || errors.Is(err, apperror.SessionExpired)
+}
+
+func (t *TokenServiceTest) TestSessionIdleTimeout() {
+	t.conf.SessionIdleTimeout = 1
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	// counted from the last refresh, so a session in use outlives the timeout
+	for i := 0; i < 2; i++ {
+		time.Sleep(600 * time.Millisecond)
+		credentials, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+		t.Require().NoError(err)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.True(t.ended(err), err)
+}
+
+func (t *TokenServiceTest) TestSessionMaxAge() {
+	t.conf.SessionMaxAge = 2
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		credentials, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+		t.Require().NoError(err)
+	}
+
+	// refreshed 300ms ago, but logged in over two seconds ago
+	time.Sleep(300 * time.Millisecond)
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.True(t.ended(err), err)
+}
+
+func (t *TokenServiceTest) TestSessionTTL() {
+	tests := []struct {
+		name        string
+		idleTimeout int
+		maxAge      int
+		expiresIn   int
+	}{
+		{name: "refresh ttl", expiresIn: 259200},
+		{name: "idle timeout", idleTimeout: 3600, expiresIn: 3600},
+		{name: "max age", idleTimeout: 3600, maxAge: 600, expiresIn: 600},
+		{name: "idle timeout within max age", idleTimeout: 3600, maxAge: 7200, expiresIn: 3600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			t.conf.SessionIdleTimeout = tt.idleTimeout
+			t.conf.SessionMaxAge = tt.maxAge
+			svc := t.newService()
+
+			credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+			t.Require().NoError(err)
+
+			introspection := svc.IntrospectToken(t.ctx, credentials.RefreshToken, dto.RefreshTokenType)
+			t.Require().True(introspection.Active)
+			t.InDelta(time.Now().Unix()+int64(tt.expiresIn), introspection.Exp, 1)
+		})
+	}
+}
+
+// storedSession reads the only session of the user from the cache.
+func (t *TokenServiceTest) TestRefreshWithoutSession() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	// the session expired between the refresh token being looked up and read
+	t.Require().NoError(t.cache.DeleteValue(t.ctx, "session:"+t.storedSession("user-id").ID))
+
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	t.False(svc.IntrospectToken(t.ctx, credentials.RefreshToken, dto.RefreshTokenType).Active)
+}
+
+func (t *TokenServiceTest) TestRefreshAfterRevocationsArePruned() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+
+	// the session outlived a RevokeAllSessions that failed to delete it, longer ago than an
+	// access token lives
+	session := t.storedSession("user-id")
+	session.CreatedAt = time.Now().Add(-3 * time.Hour)
+	t.Require().NoError(t.cache.SetValue(t.ctx, "session:"+session.ID, session, t.conf.RefreshTTL))
+	t.Require().NoError(t.cache.SetField(t.ctx, "revoked:users", "user-id", time.Now().Add(-2*time.Hour).UnixMilli()))
+
+	t.Require().NoError(t.revocations.Sync(t.ctx))
+
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.SessionExpired)
+}
+
+func (t *TokenServiceTest) TestAudience() {
+	t.conf.ClientAudiences = map[string][]string{"client": {"gateway", "checkin"}}
+	svc := t.newService()
+
+	tests := []struct {
+		name     string
+		client   *dto.ClientInfo
+		audience []string
+		err      error
+	}{
+		{name: "requested", client: &dto.ClientInfo{ClientId: "client", Audience: []string{"checkin"}}, audience: []string{"checkin"}},
+		{name: "defaults to every allowed audience", client: &dto.ClientInfo{ClientId: "client"}, audience: []string{"gateway", "checkin"}},
+		{name: "not allowed", client: &dto.ClientInfo{ClientId: "client", Audience: []string{"checkin", "admin"}}, err: apperror.AudienceNotAllowed},
+		{name: "unknown client", client: &dto.ClientInfo{ClientId: "other", Audience: []string{"gateway"}}, err: apperror.AudienceNotAllowed},
+		{name: "no client", client: &dto.ClientInfo{}, err: apperror.AudienceNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func() {
+			credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, tt.client)
+			if tt.err != nil {
+				t.ErrorIs(err, tt.err)
+				return
+			}
+			t.Require().NoError(err)
+
+			userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, tt.audience[0])
+			t.Require().NoError(err)
+			t.Equal(tt.audience, userCredentials.Audience)
+
+			// the audience is kept across refreshes
+			refreshed, err := svc.RefreshToken(t.ctx, credentials.RefreshToken)
+			t.Require().NoError(err)
+			userCredentials, err = svc.ValidateToken(t.ctx, refreshed.AccessToken, "")
+			t.Require().NoError(err)
+			t.Equal(tt.audience, userCredentials.Audience)
+		})
+	}
+}
+
+func (t *TokenServiceTest) TestAudienceNotConfigured() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, &dto.ClientInfo{ClientId: "client", Audience: []string{"gateway"}})
+	t.Require().NoError(err)
+
+	userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Empty(userCredentials.Audience)
+}
+
+func (t *TokenServiceTest) storedSession(userId string) *dto.Session {
+	sessions, err := t.cache.GetFields(t.ctx, "sessions:"+userId)
+	t.Require().NoError(err)
+	t.Require().Len(sessions, 1)
+
+	session := &dto.Session{}
+	for sessionId := range sessions {
+		t.Require().NoError(t.cache.GetValue(t.ctx, "session:"+sessionId, session))
+	}
+
+	return session
+}
+
+func (t *TokenServiceTest) TestRefreshTokenHashIsNotAToken() {
+	svc := t.newService()
+
+	credentials, err := svc.CreateCredentials(t.ctx, "user-id", constant.USER, t.client)
+	t.Require().NoError(err)
+	hash := t.storedSession("user-id").RefreshTokenHash
+
+	_, err = svc.RefreshToken(t.ctx, hash)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	t.False(svc.IntrospectToken(t.ctx, hash, dto.RefreshTokenType).Active)
+
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestLegacyRefreshTokenWithoutSession() {
+	svc := t.newService()
+	legacyToken := uuid.NewString()
+	t.Require().NoError(t.cache.SetValue(t.ctx, "refresh:"+legacyToken, map[string]string{"user_id": "user-id", "role": "staff"}, 60))
+
+	credentials, err := svc.RefreshToken(t.ctx, legacyToken)
+	t.Require().NoError(err)
+
+	userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", userCredentials.UserID)
+	t.Equal(constant.STAFF, userCredentials.Role)
+	t.Equal(t.storedSession("user-id").ID, userCredentials.SessionID)
+
+	// it migrates once
+	_, err = svc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestLegacyRefreshTokenWithoutSessionRevoked() {
+	svc := t.newService()
+	legacyToken := uuid.NewString()
+	t.Require().NoError(t.cache.SetValue(t.ctx, "refresh:"+legacyToken, map[string]string{"user_id": "user-id", "role": "staff"}, 60))
+
+	t.Require().NoError(svc.RevokeAllSessions(t.ctx, "user-id"))
+
+	_, err := svc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.SessionExpired)
+}
+
+func (t *TokenServiceTest) TestLegacyRefreshTokenWithoutSessionRoleRevoked() {
+	svc := t.newService()
+	legacyToken := uuid.NewString()
+	t.Require().NoError(t.cache.SetValue(t.ctx, "refresh:"+legacyToken, map[string]string{"user_id": "user-id", "role": "staff"}, 60))
+
+	t.Require().NoError(svc.RevokeRoleTokens(t.ctx, constant.STAFF))
+
+	_, err := svc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.SessionExpired)
+}
+
+func (t *TokenServiceTest) TestLegacyRefreshTokenWithSessionId() {
+	svc := t.newService()
+	legacyToken := uuid.NewString()
+	t.Require().NoError(t.cache.SetValue(t.ctx, "refresh:"+legacyToken, map[string]string{"user_id": "user-id", "role": "staff", "session_id": "session-id"}, 60))
+
+	// tokens stored under themselves never had a session
+	_, err := svc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	t.False(svc.IntrospectToken(t.ctx, legacyToken, dto.RefreshTokenType).Active)
+}
+
+// TestLegacyRefreshTokenInRedis migrates a refresh token written by the release before
+// sessions to the redis at REDIS_TEST_ADDR, e.g.
+// REDIS_TEST_ADDR=localhost:6379 REDIS_TEST_PASSWORD=5678 go test ./internal/token/...
+func (t *TokenServiceTest) TestLegacyRefreshTokenInRedis() {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.T().Skip("REDIS_TEST_ADDR is not set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr, Password: os.Getenv("REDIS_TEST_PASSWORD")})
+	defer client.Close()
+	prefix := fmt.Sprintf("test:%s:", uuid.NewString())
+	t.cache = cache.NewRepository(client, cache.Options{KeyPrefix: prefix, Binary: true})
+	svc := t.newService()
+
+	// plain JSON under the token itself, as that release wrote it
+	legacyToken := uuid.NewString()
+	t.Require().NoError(client.Set(t.ctx, prefix+"refresh:"+legacyToken, `{"user_id":"user-id","role":"staff"}`, time.Minute).Err())
+
+	credentials, err := svc.RefreshToken(t.ctx, legacyToken)
+	t.Require().NoError(err)
+
+	userCredentials, err := svc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal("user-id", userCredentials.UserID)
+	t.Equal(constant.STAFF, userCredentials.Role)
+
+	t.Zero(client.Exists(t.ctx, prefix+"refresh:"+legacyToken).Val())
+	_, err = svc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+	_, err = svc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *TokenServiceTest) TestRedeemQrTokenOnce() {
+	svc := t.newService()
+
+	qrToken, err := svc.CreateQrToken(t.ctx, "user-id", "checkin")
+	t.Require().NoError(err)
+
+	_, err = svc.RedeemQrToken(t.ctx, qrToken.Token, "store")
+	t.ErrorIs(err, apperror.QrTokenInvalid)
+
+	redemption, err := svc.RedeemQrToken(t.ctx, qrToken.Token, "checkin")
+	t.Require().NoError(err)
+	t.Equal("user-id", redemption.UserID)
+
+	_, err = svc.RedeemQrToken(t.ctx, qrToken.Token, "checkin")
+	t.ErrorIs(err, apperror.QrTokenConsumed)
+
+	_, err = svc.ValidateToken(t.ctx, qrToken.Token, "")
+	t.ErrorIs(err, apperror.InvalidToken)
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	"github.com/stretchr/testify/assert"
+)
+
+type cachedToken struct {
+	token     string
+	sessionId string
+	userId    string
+	expiresIn time.Duration
+}
+
+func TestValidationCache(t *testing.T) {
+	tokens := []cachedToken{
+		{token: "phone", sessionId: "phone-session", userId: "user-id", expiresIn: time.Hour},
+		{token: "laptop", sessionId: "laptop-session", userId: "user-id", expiresIn: time.Hour},
+		{token: "other", sessionId: "other-session", userId: "other-id", expiresIn: time.Hour},
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		ttl     int
+		tokens  []cachedToken
+		act     func(cache token.ValidationCache)
+		wait    time.Duration
+		present []string
+		missing []string
+	}{
+		{
+			name:    "holds every token within size",
+			size:    3,
+			ttl:     60,
+			tokens:  tokens,
+			present: []string{"phone", "laptop", "other"},
+		},
+		{
+			name:    "disabled with zero size",
+			size:    0,
+			ttl:     60,
+			tokens:  tokens,
+			missing: []string{"phone", "laptop", "other"},
+		},
+		{
+			name:    "evicts least recently set",
+			size:    2,
+			ttl:     60,
+			tokens:  tokens,
+			present: []string{"laptop", "other"},
+			missing: []string{"phone"},
+		},
+		{
+			name:   "evicts least recently used",
+			size:   2,
+			ttl:    60,
+			tokens: tokens[:2],
+			act: func(cache token.ValidationCache) {
+				cache.Get("phone")
+				cache.Set("other", credentialsFor(tokens[2]))
+			},
+			present: []string{"phone", "other"},
+			missing: []string{"laptop"},
+		},
+		{
+			name:   "setting a token again refreshes it",
+			size:   2,
+			ttl:    60,
+			tokens: tokens[:2],
+			act: func(cache token.ValidationCache) {
+				cache.Set("phone", credentialsFor(tokens[0]))
+				cache.Set("other", credentialsFor(tokens[2]))
+			},
+			present: []string{"phone", "other"},
+			missing: []string{"laptop"},
+		},
+		{
+			name:    "expires after ttl",
+			size:    3,
+			ttl:     1,
+			tokens:  tokens,
+			wait:    1100 * time.Millisecond,
+			missing: []string{"phone", "laptop", "other"},
+		},
+		{
+			name: "expires with the token before ttl",
+			size: 3,
+			ttl:  60,
+			tokens: []cachedToken{
+				{token: "short", sessionId: "short-session", userId: "user-id", expiresIn: 50 * time.Millisecond},
+				tokens[1],
+			},
+			wait:    100 * time.Millisecond,
+			present: []string{"laptop"},
+			missing: []string{"short"},
+		},
+		{
+			name:   "invalidates a session",
+			size:   3,
+			ttl:    60,
+			tokens: tokens,
+			act: func(cache token.ValidationCache) {
+				cache.InvalidateSession("phone-session")
+			},
+			present: []string{"laptop", "other"},
+			missing: []string{"phone"},
+		},
+		{
+			name:   "invalidates every session of a user",
+			size:   3,
+			ttl:    60,
+			tokens: tokens,
+			act: func(cache token.ValidationCache) {
+				cache.InvalidateUser("user-id")
+			},
+			present: []string{"other"},
+			missing: []string{"phone", "laptop"},
+		},
+		{
+			name:   "invalidating an unknown session or user keeps every token",
+			size:   3,
+			ttl:    60,
+			tokens: tokens,
+			act: func(cache token.ValidationCache) {
+				cache.InvalidateSession("unknown-session")
+				cache.InvalidateUser("unknown-id")
+			},
+			present: []string{"phone", "laptop", "other"},
+		},
+		{
+			name:   "eviction keeps the session and user index in step",
+			size:   1,
+			ttl:    60,
+			tokens: tokens[:2],
+			act: func(cache token.ValidationCache) {
+				cache.InvalidateUser("user-id")
+				cache.Set("phone", credentialsFor(tokens[0]))
+			},
+			present: []string{"phone"},
+			missing: []string{"laptop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := token.NewValidationCache(tt.size, tt.ttl)
+			for _, cached := range tt.tokens {
+				cache.Set(cached.token, credentialsFor(cached))
+			}
+			if tt.act != nil {
+				tt.act(cache)
+			}
+			time.Sleep(tt.wait)
+
+			for _, present := range tt.present {
+				credentials, ok := cache.Get(present)
+				if assert.True(t, ok, present) {
+					assert.Equal(t, present+"-session", credentials.SessionID)
+				}
+			}
+			for _, missing := range tt.missing {
+				_, ok := cache.Get(missing)
+				assert.False(t, ok, missing)
+			}
+		})
+	}
+}
+
+func credentialsFor(cached cachedToken) *dto.UserCredentials {
+	return &dto.UserCredentials{
+		UserID:    cached.userId,
+		SessionID: cached.sessionId,
+		TokenID:   cached.token,
+		ExpiresAt: time.Now().Add(cached.expiresIn),
+	}
+}
@@ -0,0 +1,193 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"go.uber.org/zap"
+)
+
+const (
+	revokedTokensKey = "revoked:tokens"
+	revokedUsersKey  = "revoked:users"
+	revokedRolesKey  = "revoked:roles"
+
+	// pruneEvery is how many revocations a replica writes between pruning the lists, so they
+	// stay bounded when nothing schedules Sync.
+	pruneEvery = 100
+)
+
+// RevocationList is the set of access tokens that must be rejected before they expire. It is
+// kept in memory and synced from the cache, so stateless validation needs no cache round
+// trip and keeps working with the last synced set while the cache is unreachable.
+type RevocationList interface {
+	// RevokeToken rejects the access token with the given jti until it expires.
+	RevokeToken(ctx context.Context, tokenId string, expiresAt time.Time) error
+	// RevokeUser rejects every access token of the user issued up to the given time, to the
+	// millisecond.
+	RevokeUser(ctx context.Context, userId string, before time.Time) error
+	// RevokeRole rejects every access token issued to the role up to the given time, to the
+	// millisecond.
+	RevokeRole(ctx context.Context, role constant.Role, before time.Time) error
+	// IsRevoked reports whether a token is rejected by its jti, its user or its role. An empty
+	// role is never revoked.
+	IsRevoked(tokenId string, userId string, role constant.Role, issuedAt time.Time) bool
+	Sync(ctx context.Context) error
+}
+
+type revocationListImpl struct {
+	mu        sync.RWMutex
+	cache     cache.Repository
+	retention int
+	tokens    map[string]int64
+	users     map[string]int64
+	roles     map[string]int64
+	writes    atomic.Int64
+	log       *zap.Logger
+}
+
+// NewRevocationList keeps the cut-offs of users and roles for retention seconds, which has to
+// cover every token they may reject, refresh tokens included; see JwtConfig.RevocationRetention.
+func NewRevocationList(cache cache.Repository, retention int, log *zap.Logger) RevocationList {
+	return &revocationListImpl{
+		cache:     cache,
+		retention: retention,
+		tokens:    map[string]int64{},
+		users:     map[string]int64{},
+		roles:     map[string]int64{},
+		log:       log,
+	}
+}
+
+func (r *revocationListImpl) RevokeToken(ctx context.Context, tokenId string, expiresAt time.Time) error {
+	if tokenId == "" {
+		return nil
+	}
+
+	if err := r.cache.SetField(ctx, revokedTokensKey, tokenId, expiresAt.Unix()); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.tokens[tokenId] = expiresAt.Unix()
+	r.mu.Unlock()
+
+	r.written(ctx)
+
+	return nil
+}
+
+func (r *revocationListImpl) RevokeUser(ctx context.Context, userId string, before time.Time) error {
+	if err := r.cache.SetField(ctx, revokedUsersKey, userId, before.UnixMilli()); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.users[userId] = before.UnixMilli()
+	r.mu.Unlock()
+
+	r.written(ctx)
+
+	return nil
+}
+
+func (r *revocationListImpl) RevokeRole(ctx context.Context, role constant.Role, before time.Time) error {
+	if err := r.cache.SetField(ctx, revokedRolesKey, string(role), before.UnixMilli()); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.roles[string(role)] = before.UnixMilli()
+	r.mu.Unlock()
+
+	r.written(ctx)
+
+	return nil
+}
+
+// written prunes the lists every pruneEvery writes. A failed prune is retried on a later write.
+func (r *revocationListImpl) written(ctx context.Context) {
+	if r.writes.Add(1)%pruneEvery != 0 {
+		return
+	}
+
+	if err := r.Sync(ctx); err != nil {
+		r.log.Named("prune").Warn("Sync: ", zap.Error(err))
+	}
+}
+
+func (r *revocationListImpl) IsRevoked(tokenId string, userId string, role constant.Role, issuedAt time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.tokens[tokenId]; ok {
+		return true
+	}
+
+	if notBefore, ok := r.users[userId]; ok && issuedAt.UnixMilli() <= notBefore {
+		return true
+	}
+
+	notBefore, ok := r.roles[string(role)]
+	return ok && issuedAt.UnixMilli() <= notBefore
+}
+
+// Sync replaces the in-memory set with the one in the cache and drops entries that can no
+// longer match an unexpired token.
+func (r *revocationListImpl) Sync(ctx context.Context) error {
+	now := time.Now()
+
+	tokens, err := r.load(ctx, revokedTokensKey, func(expiresAt int64) bool { return expiresAt < now.Unix() })
+	if err != nil {
+		return err
+	}
+
+	users, err := r.load(ctx, revokedUsersKey, func(before int64) bool { return before+int64(r.retention)*1000 < now.UnixMilli() })
+	if err != nil {
+		return err
+	}
+
+	roles, err := r.load(ctx, revokedRolesKey, func(before int64) bool { return before+int64(r.retention)*1000 < now.UnixMilli() })
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = tokens
+	r.users = users
+	r.roles = roles
+
+	return nil
+}
+
+func (r *revocationListImpl) load(ctx context.Context, key string, isStale func(int64) bool) (map[string]int64, error) {
+	fields, err := r.cache.GetFields(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]int64, len(fields))
+	stale := []string{}
+	for field, value := range fields {
+		var timestamp int64
+		if err := json.Unmarshal([]byte(value), &timestamp); err != nil || isStale(timestamp) {
+			stale = append(stale, field)
+			continue
+		}
+		entries[field] = timestamp
+	}
+
+	if len(stale) > 0 {
+		if err := r.cache.DeleteFields(ctx, key, stale...); err != nil {
+			r.log.Named("Sync").Warn("DeleteFields: ", zap.Error(err))
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,125 @@
+package token
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/redis/go-redis/v9"
+)
+
+const successorPollInterval = 50 * time.Millisecond
+
+// awaitSuccessor is used by a refresh that lost the race to rotate the token. Within the grace
+// period it waits for the winner to store the new pair and returns it; after that the token
+// counts as reused.
+func (s *serviceImpl) awaitSuccessor(ctx context.Context, refreshToken string, refreshTokenHash string) (*dto.Credentials, error) {
+	rotation := &dto.RefreshRotation{}
+	err := s.cache.GetValue(ctx, rotationKey(refreshTokenHash), rotation)
+	if errors.Is(err, redis.Nil) {
+		return nil, apperror.RefreshTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	deadline := rotation.RotatedAt.Add(time.Duration(s.jwtService.GetConfig().RefreshGracePeriod) * time.Second)
+	for time.Now().Before(deadline) {
+		var sealed string
+		err := s.cache.GetValue(ctx, successorKey(refreshTokenHash), &sealed)
+		if err == nil {
+			return openSuccessor(sealed, s.successorSealKey(refreshToken))
+		} else if !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(successorPollInterval):
+		}
+	}
+
+	return nil, apperror.RefreshTokenReused
+}
+
+// successorSealKey derives the key the new pair is encrypted with from the refresh token it
+// replaces, so only a holder of that token can read it back.
+func (s *serviceImpl) successorSealKey(refreshToken string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.jwtService.GetConfig().RefreshTokenKey()))
+	mac.Write([]byte("successor:" + refreshToken))
+	return mac.Sum(nil)
+}
+
+func sealSuccessor(credentials *dto.Credentials, key []byte) (string, error) {
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func openSuccessor(sealed string, key []byte) (*dto.Credentials, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed successor is too short")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := &dto.Credentials{}
+	if err := json.Unmarshal(plaintext, credentials); err != nil {
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func rotationKey(refreshTokenHash string) string {
+	return fmt.Sprintf("refresh:%s:rotation", refreshTokenHash)
+}
+
+func successorKey(refreshTokenHash string) string {
+	return fmt.Sprintf("refresh:%s:successor", refreshTokenHash)
+}
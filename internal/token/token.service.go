@@ -1,212 +1,866 @@
 package token
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"time"
 
-	_jwt "github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
 	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
 	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
 	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
 	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
+var degradedValidations = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "auth_degraded_validations_total",
+	Help: "Number of access tokens accepted on their signature alone because the cache was unavailable.",
+})
+
 type Service interface {
-	GetCredentials(userId string, role constant.Role) (*dto.Credentials, error)
-	CreateCredentials(userId string, role constant.Role) (*dto.Credentials, error)
-	RefreshToken(refreshToken string) (*dto.Credentials, error)
-	ValidateToken(token string) (*dto.UserCredentials, error)
+	CreateCredentials(ctx context.Context, userId string, role constant.Role, client *dto.ClientInfo) (*dto.Credentials, error)
+	CreateImpersonationCredentials(ctx context.Context, userId string, role constant.Role, actorId string) (*dto.Credentials, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*dto.Credentials, error)
+	ValidateToken(ctx context.Context, token string, audience string) (*dto.UserCredentials, error)
+	IntrospectToken(ctx context.Context, token string, tokenTypeHint string) *dto.TokenIntrospection
+	CreateServiceToken(ctx context.Context, clientId string) (*dto.Credentials, error)
+	CreateQrToken(ctx context.Context, userId string, purpose string) (*dto.QrToken, error)
+	RedeemQrToken(ctx context.Context, token string, purpose string) (*dto.QrTokenRedemption, error)
+	ValidateServiceToken(ctx context.Context, token string) (*dto.ServiceCredentials, error)
+	RevokeSession(ctx context.Context, sessionId string) error
+	RevokeAllSessions(ctx context.Context, userId string) error
+	RevokeRoleTokens(ctx context.Context, role constant.Role) error
 	GetConfig() *config.JwtConfig
 }
 
 type serviceImpl struct {
-	jwtService jwt.Service
-	cache      cache.Repository
-	tokenUtils TokenUtils
-	log        *zap.Logger
+	jwtService      jwt.Service
+	permissionSvc   permission.Service
+	cache           cache.Repository
+	revocations     RevocationList
+	validationCache ValidationCache
+	tokenUtils      TokenUtils
+	log             *zap.Logger
 }
 
-func NewService(jwtService jwt.Service, cache cache.Repository, tokenUtils TokenUtils, log *zap.Logger) Service {
+func NewService(jwtService jwt.Service, permissionSvc permission.Service, cache cache.Repository, revocations RevocationList, validationCache ValidationCache, tokenUtils TokenUtils, log *zap.Logger) Service {
 	return &serviceImpl{
-		jwtService: jwtService,
-		cache:      cache,
-		tokenUtils: tokenUtils,
-		log:        log,
+		jwtService:      jwtService,
+		permissionSvc:   permissionSvc,
+		cache:           cache,
+		revocations:     revocations,
+		validationCache: validationCache,
+		tokenUtils:      tokenUtils,
+		log:             log,
+	}
+}
+
+// CreateCredentials starts a new session for the given device. Every login gets its own
+// session record, so sessions on other devices of the same user are left untouched.
+func (s *serviceImpl) CreateCredentials(ctx context.Context, userId string, role constant.Role, client *dto.ClientInfo) (*dto.Credentials, error) {
+	audience, err := s.resolveAudience(client)
+	if err != nil {
+		s.log.Named("CreateCredentials").Info("resolveAudience: ", zap.String("clientId", client.ClientId), zap.Error(err))
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &dto.Session{
+		ID:         s.tokenUtils.GetNewUUID().String(),
+		UserID:     userId,
+		Role:       role,
+		Device:     client.Device,
+		ClientId:   client.ClientId,
+		Audience:   audience,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	credentials, err := s.issueCredentials(ctx, session, "")
+	if err != nil {
+		s.log.Named("CreateCredentials").Error("issueCredentials: ", zap.Error(err))
+		return nil, err
+	}
+
+	return credentials, nil
+}
+
+// CreateImpersonationCredentials lets a staff member act as another user. The access token
+// carries the staff member in its act claim, lives for the impersonation TTL and comes
+// without a refresh token.
+func (s *serviceImpl) CreateImpersonationCredentials(ctx context.Context, userId string, role constant.Role, actorId string) (*dto.Credentials, error) {
+	now := time.Now()
+	session := &dto.Session{
+		ID:         s.tokenUtils.GetNewUUID().String(),
+		UserID:     userId,
+		Role:       role,
+		ActorId:    actorId,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	credentials, err := s.issueCredentials(ctx, session, "")
+	if err != nil {
+		s.log.Named("CreateImpersonationCredentials").Error("issueCredentials: ", zap.Error(err))
+		return nil, err
 	}
+
+	return credentials, nil
 }
 
-func (s *serviceImpl) GetCredentials(userId string, role constant.Role) (*dto.Credentials, error) {
-	credentials := &dto.Credentials{}
-	err := s.cache.GetValue(sessionKey(userId), credentials)
+// RefreshToken rotates a refresh token. Exactly one refresh gets to rotate a given token;
+// concurrent or repeated refreshes with it get the same new pair within the grace period and
+// are treated as reuse after it.
+func (s *serviceImpl) RefreshToken(ctx context.Context, refreshToken string) (*dto.Credentials, error) {
+	refreshCache, err := s.findRefreshToken(ctx, refreshToken)
 	if err != nil {
-		s.log.Named("tokenSvc").Named("GetCredentials").Info("No session found in cache for user", zap.String("userId", userId))
-		credentials, err = s.CreateCredentials(userId, role)
+		s.log.Named("RefreshToken").Info("findRefreshToken: ", zap.Error(err))
+		return nil, err
+	}
+	if refreshCache.SessionID == "" {
+		credentials, err := s.migrateRefreshToken(ctx, refreshToken)
 		if err != nil {
-			s.log.Named("GetCredentials").Error("CreateCredentials: ", zap.Error(err))
+			s.log.Named("RefreshToken").Info("migrateRefreshToken: ", zap.Error(err))
 			return nil, err
 		}
+		return credentials, nil
 	}
+	refreshTokenHash := s.hashRefreshToken(refreshToken)
 
-	_, err = s.jwtService.ValidateToken(credentials.AccessToken)
-	if err != nil { // still have refreshToken but accessToken is expired
-		err := s.cache.DeleteValue(sessionKey(userId))
-		if err != nil {
-			s.log.Named("GetCredentials").Error("DeleteValue: ", zap.Error(err))
+	claimed, err := s.cache.SetValueNX(ctx, rotationKey(refreshTokenHash), &dto.RefreshRotation{RotatedAt: time.Now()}, s.jwtService.GetConfig().RefreshTTL)
+	if err != nil {
+		s.log.Named("RefreshToken").Error("SetValueNX rotation: ", zap.Error(err))
+		return nil, err
+	}
+
+	if !claimed {
+		credentials, err := s.awaitSuccessor(ctx, refreshToken, refreshTokenHash)
+		if err == nil {
+			return credentials, nil
+		} else if !errors.Is(err, apperror.RefreshTokenReused) {
+			s.log.Named("RefreshToken").Error("awaitSuccessor: ", zap.Error(err))
 			return nil, err
 		}
 
-		accessToken, err := s.jwtService.CreateToken(userId, role)
-		if err != nil {
-			s.log.Named("GetCredentials").Error("CreateToken: ", zap.Error(err))
+		s.log.Named("RefreshToken").Warn("security event: rotated refresh token was reused, revoking token family",
+			zap.String("userId", refreshCache.UserID), zap.String("sessionId", refreshCache.SessionID))
+		if err := s.revokeFamily(ctx, refreshCache.SessionID); err != nil {
+			s.log.Named("RefreshToken").Error("revokeFamily: ", zap.Error(err))
 			return nil, err
 		}
+		return nil, apperror.RefreshTokenReused
+	}
 
-		newCredentials := &dto.Credentials{
-			AccessToken:  accessToken,
-			RefreshToken: credentials.RefreshToken,
-			ExpiresIn:    s.jwtService.GetConfig().AccessTTL,
+	// the session may have expired or been revoked since the token was looked up
+	session := &dto.Session{}
+	err = s.cache.GetValue(ctx, sessionKey(refreshCache.SessionID), session)
+	if errors.Is(err, redis.Nil) {
+		return nil, apperror.RefreshTokenNotFound
+	} else if err != nil {
+		s.log.Named("RefreshToken").Error("GetValue session: ", zap.Error(err))
+		return nil, err
+	}
+
+	if session.ActorId != "" {
+		s.log.Named("RefreshToken").Warn("refresh of an impersonation session refused",
+			zap.String("userId", session.UserID), zap.String("actorId", session.ActorId))
+		return nil, apperror.NotRefreshable
+	}
+
+	// a refresh that raced with RevokeAllSessions must not bring the session back
+	if s.revocations.IsRevoked("", session.UserID, "", session.CreatedAt) {
+		s.log.Named("RefreshToken").Info("session started before the user's tokens were revoked", zap.String("userId", session.UserID), zap.String("sessionId", session.ID))
+		if err := s.revokeFamily(ctx, session.ID); err != nil {
+			s.log.Named("RefreshToken").Error("revokeFamily: ", zap.Error(err))
+			return nil, err
 		}
+		return nil, apperror.SessionExpired
+	}
 
-		err = s.cache.SetValue(sessionKey(userId), newCredentials, s.jwtService.GetConfig().AccessTTL)
-		if err != nil {
-			s.log.Named("GetCredentials").Error("SetValue: ", zap.Error(err))
+	if s.sessionTTL(session) <= 0 {
+		s.log.Named("RefreshToken").Info("session expired", zap.String("userId", session.UserID), zap.String("sessionId", session.ID),
+			zap.Time("createdAt", session.CreatedAt), zap.Time("lastSeenAt", session.LastSeenAt))
+		if err := s.revokeFamily(ctx, session.ID); err != nil {
+			s.log.Named("RefreshToken").Error("revokeFamily: ", zap.Error(err))
 			return nil, err
 		}
+		return nil, apperror.SessionExpired
+	}
+
+	session.LastSeenAt = time.Now()
 
-		return newCredentials, nil
+	credentials, err := s.issueCredentials(ctx, session, refreshToken)
+	if err != nil {
+		s.log.Named("RefreshToken").Error("issueCredentials: ", zap.Error(err))
+		// let the client retry with the same token rather than have the retry count as reuse,
+		// also when the refresh failed because the client gave up
+		if err := s.cache.DeleteValue(context.WithoutCancel(ctx), rotationKey(refreshTokenHash)); err != nil {
+			s.log.Named("RefreshToken").Error("DeleteValue rotation: ", zap.Error(err))
+		}
+		return nil, err
 	}
 
 	return credentials, nil
 }
 
-func (s *serviceImpl) CreateCredentials(userId string, role constant.Role) (*dto.Credentials, error) {
-	accessToken, err := s.jwtService.CreateToken(userId, role)
+// ValidateToken checks an access token. When audience is given the token must have been
+// issued for it.
+func (s *serviceImpl) ValidateToken(ctx context.Context, token string, audience string) (*dto.UserCredentials, error) {
+	if credentials, ok := s.validationCache.Get(token); ok {
+		if !s.revocations.IsRevoked(credentials.TokenID, credentials.UserID, credentials.Role, credentials.IssuedAt) {
+			if audience != "" && !slices.Contains(credentials.Audience, audience) {
+				return nil, apperror.InvalidToken.Wrap(fmt.Errorf("token is not valid for audience %s", audience))
+			}
+			return credentials, nil
+		}
+		s.validationCache.InvalidateSession(credentials.SessionID)
+	}
+
+	payload, err := s.jwtService.ValidateToken(token, audience)
 	if err != nil {
-		s.log.Named("CreateCredentials").Error("CreateToken: ", zap.Error(err))
+		s.log.Named("ValidateToken").Error("ValidateToken: ", zap.Error(err))
 		return nil, err
 	}
 
-	refreshToken := createRefreshToken()
+	// service and qr tokens are marked with token_use, access tokens never are
+	if payload.TokenUse != "" || payload.Issuer != s.jwtService.GetConfig().Issuer {
+		return nil, apperror.InvalidToken
+	}
+
+	if payload.ExpiresAt.Before(time.Now()) {
+		return nil, apperror.TokenExpired
+	}
+
+	if payload.UserId == "" {
+		s.log.Named("ValidateToken").Error("user_id not found in payloads")
+		return nil, apperror.InvalidToken.Wrap(errors.New("user_id not found in payloads"))
+	}
+
+	if payload.Role == "" {
+		s.log.Named("ValidateToken").Error("role not found in payloads")
+		return nil, apperror.InvalidToken.Wrap(errors.New("role not found in payloads"))
+	}
+
+	if payload.SessionId == "" {
+		s.log.Named("ValidateToken").Error("session_id not found in payloads")
+		return nil, apperror.InvalidToken.Wrap(errors.New("session_id not found in payloads"))
+	}
 
-	err = s.cache.SetValue(refreshKey(refreshToken), &dto.RefreshTokenCache{
-		UserID: userId,
-		Role:   role,
-	}, s.jwtService.GetConfig().RefreshTTL)
+	userId, sessionId, tokenId, actorId := payload.UserId, payload.SessionId, payload.TokenId, payload.ActorId
+
+	if s.jwtService.GetConfig().IsStatelessValidation() && tokenId == "" {
+		s.log.Named("ValidateToken").Error("jti not found in payloads")
+		return nil, apperror.InvalidToken.Wrap(errors.New("jti not found in payloads"))
+	}
+
+	// checked in both modes, as it is what rejects tokens issued before a role change or ban
+	if s.revocations.IsRevoked(tokenId, userId, payload.Role, payload.IssuedAt) {
+		return nil, apperror.TokenRevoked
+	}
+
+	degraded := false
+	if !s.jwtService.GetConfig().IsStatelessValidation() {
+		session := &dto.Session{}
+		err = s.cache.GetValue(ctx, sessionKey(sessionId), session)
+		switch {
+		case errors.Is(err, redis.Nil):
+			return nil, apperror.TokenRevoked
+		case s.acceptWithoutSession(ctx, err):
+			s.log.Named("ValidateToken").Warn("cache unavailable, accepting token on its signature", zap.String("userId", userId), zap.String("sessionId", sessionId), zap.Error(err))
+			degradedValidations.Inc()
+			degraded = true
+		case err != nil:
+			s.log.Named("ValidateToken").Error("GetValue: ", zap.Error(err))
+			return nil, err
+		case tokenId == "" || tokenId != session.AccessTokenId || session.UserID != userId || session.ActorId != actorId:
+			return nil, apperror.TokenRevoked
+		}
+	}
+
+	credentials := &dto.UserCredentials{
+		UserID:    userId,
+		Role:      payload.Role,
+		SessionID: sessionId,
+		TokenID:   tokenId,
+		Issuer:    payload.Issuer,
+		Audience:  payload.Audience,
+		Scopes:    payload.Scopes,
+		ActorID:   actorId,
+		IssuedAt:  payload.IssuedAt,
+		ExpiresAt: payload.ExpiresAt,
+	}
+
+	// a token accepted without its session is checked again on its next use
+	if !degraded {
+		s.validationCache.Set(token, credentials)
+	}
+
+	return credentials, nil
+}
+
+// acceptWithoutSession reports whether the degraded policy lets an access token through on its
+// signature, expiry and the revocation list because its session could not be read.
+func (s *serviceImpl) acceptWithoutSession(ctx context.Context, err error) bool {
+	return errors.Is(err, apperror.CacheUnavailable) && ctx.Err() == nil && s.jwtService.GetConfig().IsSignatureOnlyWhenDegraded()
+}
+
+// IntrospectToken reports whether an access or refresh token is active following RFC 7662.
+// Any token that cannot be used, for whatever reason, is reported as inactive.
+func (s *serviceImpl) IntrospectToken(ctx context.Context, token string, tokenTypeHint string) *dto.TokenIntrospection {
+	introspectors := []func(context.Context, string) (*dto.TokenIntrospection, error){s.introspectAccessToken, s.introspectRefreshToken}
+	if tokenTypeHint == dto.RefreshTokenType {
+		introspectors = []func(context.Context, string) (*dto.TokenIntrospection, error){s.introspectRefreshToken, s.introspectAccessToken}
+	}
+
+	for _, introspect := range introspectors {
+		introspection, err := introspect(ctx, token)
+		if err == nil {
+			return introspection
+		}
+	}
+
+	return &dto.TokenIntrospection{Active: false}
+}
+
+func (s *serviceImpl) introspectAccessToken(ctx context.Context, token string) (*dto.TokenIntrospection, error) {
+	credentials, err := s.ValidateToken(ctx, token, "")
 	if err != nil {
-		s.log.Named("CreateCredentials").Error("SetValue refresh: ", zap.Error(err))
 		return nil, err
 	}
 
-	credentials := &dto.Credentials{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    s.jwtService.GetConfig().AccessTTL,
+	var act *dto.ActorClaim
+	if credentials.ActorID != "" {
+		act = &dto.ActorClaim{Sub: credentials.ActorID}
 	}
 
-	err = s.cache.SetValue(sessionKey(userId), credentials, s.jwtService.GetConfig().AccessTTL)
+	return &dto.TokenIntrospection{
+		Active:    true,
+		Scope:     strings.Join(credentials.Scopes, " "),
+		TokenType: dto.AccessTokenType,
+		Exp:       credentials.ExpiresAt.Unix(),
+		Iat:       credentials.IssuedAt.Unix(),
+		Sub:       credentials.UserID,
+		Iss:       credentials.Issuer,
+		Aud:       credentials.Audience,
+		Jti:       credentials.TokenID,
+		SessionId: credentials.SessionID,
+		Role:      string(credentials.Role),
+		Act:       act,
+	}, nil
+}
+
+func (s *serviceImpl) introspectRefreshToken(ctx context.Context, token string) (*dto.TokenIntrospection, error) {
+	refreshCache, err := s.findRefreshToken(ctx, token)
 	if err != nil {
-		s.log.Named("CreateCredentials").Error("SetValue session: ", zap.Error(err))
 		return nil, err
+	} else if refreshCache.SessionID == "" {
+		return nil, apperror.RefreshTokenNotFound
 	}
 
-	return credentials, nil
+	session := &dto.Session{}
+	err = s.cache.GetValue(ctx, sessionKey(refreshCache.SessionID), session)
+	if errors.Is(err, redis.Nil) {
+		return nil, apperror.RefreshTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if session.RefreshTokenHash != s.hashRefreshToken(token) {
+		return nil, apperror.RefreshTokenNotFound
+	}
+
+	return &dto.TokenIntrospection{
+		Active:    true,
+		TokenType: dto.RefreshTokenType,
+		Exp:       time.Now().Add(time.Duration(s.sessionTTL(session)) * time.Second).Unix(),
+		Iat:       session.LastSeenAt.Unix(),
+		Sub:       session.UserID,
+		Iss:       s.jwtService.GetConfig().Issuer,
+		Aud:       session.Audience,
+		ClientId:  session.ClientId,
+		SessionId: session.ID,
+		Role:      string(session.Role),
+	}, nil
 }
 
-func (s *serviceImpl) RefreshToken(refreshToken string) (*dto.Credentials, error) {
-	refreshCache := &dto.RefreshTokenCache{}
-	err := s.cache.GetValue(refreshKey(refreshToken), refreshCache)
+// CreateServiceToken issues a short-lived machine token to an authenticated service client.
+// Machine tokens have no session or refresh token.
+func (s *serviceImpl) CreateServiceToken(ctx context.Context, clientId string) (*dto.Credentials, error) {
+	accessToken, err := s.jwtService.CreateServiceToken(clientId, s.tokenUtils.GetNewUUID().String())
 	if err != nil {
-		s.log.Named("RefreshToken").Error("GetValue: ", zap.Error(err))
+		s.log.Named("CreateServiceToken").Error("CreateServiceToken: ", zap.Error(err))
 		return nil, err
-	} else if (refreshCache == &dto.RefreshTokenCache{}) {
-		s.log.Named("RefreshToken").Info("GetValue: refresh token not found")
-		return nil, fmt.Errorf("refresh token not found")
 	}
 
-	err = s.cache.DeleteValue(refreshKey(refreshToken))
+	return &dto.Credentials{
+		AccessToken: accessToken,
+		ExpiresIn:   s.jwtService.GetConfig().ServiceTokenTTL,
+	}, nil
+}
+
+func (s *serviceImpl) ValidateServiceToken(ctx context.Context, token string) (*dto.ServiceCredentials, error) {
+	payload, err := s.jwtService.ValidateToken(token, "")
 	if err != nil {
-		s.log.Named("RefreshToken").Error("DeleteValue refresh: ", zap.Error(err))
-		return nil, err
+		s.log.Named("ValidateServiceToken").Error("ValidateToken: ", zap.Error(err))
+		return nil, apperror.InvalidServiceToken.Wrap(err)
+	}
+
+	if payload.Issuer != s.jwtService.GetConfig().Issuer || payload.TokenUse != dto.ServiceTokenUse {
+		return nil, apperror.InvalidServiceToken
+	}
+
+	if payload.ClientId == "" {
+		return nil, apperror.InvalidServiceToken.Wrap(errors.New("client_id not found in payloads"))
+	}
+
+	return &dto.ServiceCredentials{
+		ClientId:  payload.ClientId,
+		TokenID:   payload.TokenId,
+		ExpiresAt: payload.ExpiresAt,
+	}, nil
+}
+
+// CreateQrToken mints a token for the user to show as a QR code, e.g. to be scanned at event
+// check-in. It expires after QrTokenTTL and can only be redeemed once, for the same purpose.
+func (s *serviceImpl) CreateQrToken(ctx context.Context, userId string, purpose string) (*dto.QrToken, error) {
+	if purpose == "" {
+		return nil, apperror.QrTokenInvalid
 	}
 
-	err = s.cache.DeleteValue(sessionKey(refreshCache.UserID))
+	token, err := s.jwtService.CreateQrToken(userId, purpose, s.tokenUtils.GetNewUUID().String())
 	if err != nil {
-		s.log.Named("RefreshToken").Error("DeleteValue session: ", zap.Error(err))
+		s.log.Named("CreateQrToken").Error("CreateQrToken: ", zap.Error(err))
 		return nil, err
 	}
 
-	credentials, err := s.CreateCredentials(refreshCache.UserID, refreshCache.Role)
+	return &dto.QrToken{
+		Token:     token,
+		Purpose:   purpose,
+		ExpiresIn: s.jwtService.GetConfig().QrTokenTTL,
+	}, nil
+}
+
+// RedeemQrToken checks a scanned QR token and marks it consumed. Marking uses SET NX, so of
+// concurrent redemptions of the same token exactly one succeeds.
+func (s *serviceImpl) RedeemQrToken(ctx context.Context, token string, purpose string) (*dto.QrTokenRedemption, error) {
+	payload, err := s.jwtService.ValidateToken(token, "")
 	if err != nil {
-		s.log.Named("RefreshToken").Error("CreateCredentials: ", zap.Error(err))
+		s.log.Named("RedeemQrToken").Info("ValidateToken: ", zap.Error(err))
+		return nil, apperror.QrTokenInvalid
+	}
+
+	if payload.Issuer != s.jwtService.GetConfig().Issuer || payload.TokenUse != dto.QrTokenUse || payload.Purpose != purpose {
+		return nil, apperror.QrTokenInvalid
+	}
+
+	userId, tokenId := payload.UserId, payload.TokenId
+	if userId == "" || tokenId == "" {
+		return nil, apperror.QrTokenInvalid
+	}
+
+	// the marker only has to outlive the token, after which the signature check rejects it
+	ttl := int(time.Until(payload.ExpiresAt).Seconds()) + 1
+	redemption := &dto.QrTokenRedemption{
+		UserID:  userId,
+		Purpose: purpose,
+		TokenID: tokenId,
+	}
+
+	ok, err := s.cache.SetValueNX(ctx, qrTokenKey(tokenId), redemption, ttl)
+	if err != nil {
+		s.log.Named("RedeemQrToken").Error("SetValueNX: ", zap.Error(err))
 		return nil, err
+	} else if !ok {
+		s.log.Named("RedeemQrToken").Warn("qr token redeemed twice", zap.String("userId", userId), zap.String("tokenId", tokenId))
+		return nil, apperror.QrTokenConsumed
 	}
 
-	return credentials, nil
+	return redemption, nil
+}
+
+func (s *serviceImpl) RevokeSession(ctx context.Context, sessionId string) error {
+	if err := s.revokeFamily(ctx, sessionId); err != nil {
+		s.log.Named("RevokeSession").Error("revokeFamily: ", zap.Error(err))
+		return err
+	}
+
+	return nil
 }
 
-func (s *serviceImpl) ValidateToken(token string) (*dto.UserCredentials, error) {
-	jwtToken, err := s.jwtService.ValidateToken(token)
+// RevokeAllSessions signs the user out everywhere. Every token issued to the user until now
+// is rejected, which is also how a role change or ban reaches tokens that were already issued.
+func (s *serviceImpl) RevokeAllSessions(ctx context.Context, userId string) error {
+	// the cut-off goes first so that a session refreshed while the others are being deleted is
+	// still rejected
+	err := s.revocations.RevokeUser(ctx, userId, time.Now())
+	if err != nil {
+		s.log.Named("RevokeAllSessions").Error("RevokeUser: ", zap.Error(err))
+		return err
+	}
+	s.validationCache.InvalidateUser(userId)
+
+	sessions, err := s.cache.GetFields(ctx, userSessionsKey(userId))
+	if err != nil {
+		s.log.Named("RevokeAllSessions").Error("GetFields: ", zap.Error(err))
+		return err
+	}
+
+	// each session leaves the index as it is revoked, so logins after the cut-off stay in it
+	for sessionId := range sessions {
+		if err := s.revokeFamily(ctx, sessionId); err != nil {
+			s.log.Named("RevokeAllSessions").Error("revokeFamily: ", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokeRoleTokens rejects every access token issued to the role until now, so a permission
+// taken from the role is out of every token's scopes. Sessions are kept: their next refresh
+// issues a token with the role's current permissions.
+func (s *serviceImpl) RevokeRoleTokens(ctx context.Context, role constant.Role) error {
+	err := s.revocations.RevokeRole(ctx, role, time.Now())
+	if err != nil {
+		s.log.Named("RevokeRoleTokens").Error("RevokeRole: ", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *serviceImpl) GetConfig() *config.JwtConfig {
+	return s.jwtService.GetConfig()
+}
+
+// issueCredentials mints a new access/refresh pair for the session, adds it to the user's
+// session index and stores the refresh token and the updated session record in one transaction. When it
+// replaces previousToken the pair is stored, sealed with that token, for duplicate refreshes
+// within the grace period. Impersonation sessions get an access token only.
+func (s *serviceImpl) issueCredentials(ctx context.Context, session *dto.Session, previousToken string) (*dto.Credentials, error) {
+	if err := s.revokeAccessToken(ctx, session); err != nil {
+		return nil, err
+	}
+
+	// permissions are looked up on every refresh so grants and revocations reach existing sessions
+	scopes, err := s.permissionSvc.GetPermissions(session.UserID, session.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenId := s.tokenUtils.GetNewUUID().String()
+	accessToken, err := s.jwtService.CreateToken(&dto.TokenClaims{
+		UserId:    session.UserID,
+		Role:      session.Role,
+		SessionId: session.ID,
+		TokenId:   tokenId,
+		Audience:  session.Audience,
+		Scopes:    scopes,
+		ActorId:   session.ActorId,
+		TTL:       s.accessTTL(session),
+	})
 	if err != nil {
-		s.log.Named("ValidateToken").Error("ValidateToken: ", zap.Error(err))
 		return nil, err
 	}
 
-	payloads := jwtToken.Claims.(_jwt.MapClaims)
-	if payloads["iss"] != s.jwtService.GetConfig().Issuer {
-		return nil, errors.New("invalid token")
+	entries := []cache.Entry{}
+	refreshToken := ""
+	refreshTokenHash := ""
+	sessionTTL := s.accessTTL(session)
+	if session.ActorId == "" {
+		sessionTTL = s.sessionTTL(session)
+		if sessionTTL <= 0 { // a zero ttl would store the refresh token without expiry
+			return nil, apperror.SessionExpired
+		}
+
+		refreshToken, err = s.tokenUtils.GenerateRefreshToken()
+		if err != nil {
+			return nil, err
+		}
+		refreshTokenHash = s.hashRefreshToken(refreshToken)
+
+		entries = append(entries, cache.Entry{
+			Key: refreshKey(refreshTokenHash),
+			Value: &dto.RefreshTokenCache{
+				UserID:    session.UserID,
+				Role:      session.Role,
+				SessionID: session.ID,
+			},
+			TTL: sessionTTL,
+		})
+	}
+
+	credentials := &dto.Credentials{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    s.accessTTL(session),
 	}
 
-	if time.Unix(int64(payloads["exp"].(float64)), 0).Before(time.Now()) {
-		return nil, errors.New("expired token")
+	if gracePeriod := s.jwtService.GetConfig().RefreshGracePeriod; previousToken != "" && gracePeriod > 0 {
+		sealed, err := sealSuccessor(credentials, s.successorSealKey(previousToken))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, cache.Entry{Key: successorKey(s.hashRefreshToken(previousToken)), Value: sealed, TTL: gracePeriod})
 	}
 
-	credentials := &dto.Credentials{}
+	session.AccessTokenId = tokenId
+	session.RefreshTokenHash = refreshTokenHash
+	entries = append(entries, cache.Entry{Key: sessionKey(session.ID), Value: session, TTL: sessionTTL})
+
+	// indexed before it is stored, so RevokeAllSessions finds every session that exists
+	if err := s.trackSession(ctx, session, sessionTTL); err != nil {
+		return nil, err
+	}
 
-	err = s.cache.GetValue(sessionKey(payloads["user_id"].(string)), credentials)
+	err = s.cache.SetValues(ctx, entries...)
 	if err != nil {
-		s.log.Named("ValidateToken").Error("GetValue: ", zap.Error(err))
 		return nil, err
 	}
 
-	if token != credentials.AccessToken {
-		return nil, errors.New("invalid token")
+	return credentials, nil
+}
+
+// sessionTTL is how many more seconds the session's refresh token may be used: the refresh
+// TTL, cut short by the idle timeout counted from the last refresh and by the maximum age
+// counted from login.
+func (s *serviceImpl) sessionTTL(session *dto.Session) int {
+	conf := s.jwtService.GetConfig()
+	now := time.Now()
+
+	// rounded up, so a session with part of a second left is not cut short by a whole one
+	ttl := conf.RefreshTTL
+	if conf.SessionIdleTimeout > 0 {
+		ttl = min(ttl, int(math.Ceil(session.LastSeenAt.Add(time.Duration(conf.SessionIdleTimeout)*time.Second).Sub(now).Seconds())))
+	}
+	if conf.SessionMaxAge > 0 {
+		ttl = min(ttl, int(math.Ceil(session.CreatedAt.Add(time.Duration(conf.SessionMaxAge)*time.Second).Sub(now).Seconds())))
+	}
+
+	return ttl
+}
+
+func (s *serviceImpl) accessTTL(session *dto.Session) int {
+	if session.ActorId != "" {
+		return s.jwtService.GetConfig().ImpersonationTTL
 	}
 
-	userId, ok := payloads["user_id"].(string)
-	if !ok {
-		s.log.Named("ValidateToken").Error("user_id not found in payloads")
-		return nil, fmt.Errorf("user_id not found in payloads")
+	return s.jwtService.GetConfig().AccessTTL
+}
+
+// revokeFamily ends the session a refresh token family belongs to, which invalidates its
+// access token and the latest refresh token. Rotated tokens are kept so later replays are
+// still reported. The session is taken with GETDEL, so concurrent revocations do the rest once.
+func (s *serviceImpl) revokeFamily(ctx context.Context, sessionId string) error {
+	session := &dto.Session{}
+	if err := s.cache.GetDelValue(ctx, sessionKey(sessionId), session); err != nil {
+		if errors.Is(err, redis.Nil) { // the session has already expired or been revoked
+			return nil
+		}
+		return err
+	}
+
+	if err := s.revokeAccessToken(ctx, session); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	if session.RefreshTokenHash != "" {
+		keys = append(keys, refreshKey(session.RefreshTokenHash))
 	}
 
-	role, ok := payloads["role"]
+	if err := s.cache.DeleteValues(ctx, keys...); err != nil {
+		return err
+	}
+
+	return s.untrackSession(ctx, session)
+}
+
+// resolveAudience checks the requested audience against the ones the client may request. A
+// client that asks for nothing gets every audience it is allowed.
+func (s *serviceImpl) resolveAudience(client *dto.ClientInfo) ([]string, error) {
+	clientAudiences := s.jwtService.GetConfig().ClientAudiences
+	if len(clientAudiences) == 0 {
+		return nil, nil
+	}
+
+	allowed, ok := clientAudiences[client.ClientId]
 	if !ok {
-		s.log.Named("ValidateToken").Error("role not found in payloads")
-		return nil, fmt.Errorf("role not found in payloads")
+		return nil, apperror.AudienceNotAllowed
 	}
 
-	return &dto.UserCredentials{
-		UserID: userId,
-		Role:   constant.Role(role.(string)),
-	}, nil
+	if len(client.Audience) == 0 {
+		return allowed, nil
+	}
 
+	for _, audience := range client.Audience {
+		if !slices.Contains(allowed, audience) {
+			return nil, apperror.AudienceNotAllowed
+		}
+	}
+
+	return client.Audience, nil
 }
 
-func (s *serviceImpl) GetConfig() *config.JwtConfig {
-	return s.jwtService.GetConfig()
+// revokeAccessToken adds the session's current access token to the revocation list, which is
+// what ends it when tokens are validated without looking up the session or from the
+// validation cache of another replica.
+func (s *serviceImpl) revokeAccessToken(ctx context.Context, session *dto.Session) error {
+	s.validationCache.InvalidateSession(session.ID)
+
+	if session.AccessTokenId == "" {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(time.Duration(s.accessTTL(session)) * time.Second)
+	return s.revocations.RevokeToken(ctx, session.AccessTokenId, expiresAt)
+}
+
+// trackSession adds the session to the user's session index, which is what lets every device
+// of a user be signed out at once. The index is a hash of session ids to when they expire, in
+// Unix milliseconds, so concurrent logins each write their own field. Sessions that have
+// expired are dropped.
+func (s *serviceImpl) trackSession(ctx context.Context, session *dto.Session, ttl int) error {
+	key := userSessionsKey(session.UserID)
+	sessions, err := s.cache.GetFields(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expired := []string{}
+	for sessionId, value := range sessions {
+		var expiresAt int64
+		if err := json.Unmarshal([]byte(value), &expiresAt); err != nil || expiresAt <= now.UnixMilli() {
+			expired = append(expired, sessionId)
+		}
+	}
+	if len(expired) > 0 {
+		if err := s.cache.DeleteFields(ctx, key, expired...); err != nil {
+			return err
+		}
+	}
+
+	if err := s.cache.SetField(ctx, key, session.ID, now.Add(time.Duration(ttl)*time.Second).UnixMilli()); err != nil {
+		return err
+	}
+
+	// no session outlives the refresh TTL, so neither does the index of a user who is gone
+	return s.cache.Expire(ctx, key, s.jwtService.GetConfig().RefreshTTL)
+}
+
+func (s *serviceImpl) untrackSession(ctx context.Context, session *dto.Session) error {
+	return s.cache.DeleteFields(ctx, userSessionsKey(session.UserID), session.ID)
+}
+
+// findRefreshToken looks the token up by its hash. Tokens from before sessions existed are
+// uuids stored under the token itself as just their user and role, so for those the plaintext
+// is looked up too, in the same round trip, and returned without a session id for the caller
+// to migrate.
+func (s *serviceImpl) findRefreshToken(ctx context.Context, refreshToken string) (*dto.RefreshTokenCache, error) {
+	hashed, legacy := &dto.RefreshTokenCache{}, &dto.RefreshTokenCache{}
+	keys, values := []string{refreshKey(s.hashRefreshToken(refreshToken))}, []interface{}{hashed}
+	// only a uuid is looked up as itself, so a stored hash is never taken for a token
+	if isLegacyRefreshToken(refreshToken) {
+		keys, values = append(keys, refreshKey(refreshToken)), append(values, legacy)
+	}
+
+	found, err := s.cache.GetValues(ctx, keys, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if found[0] && hashed.SessionID != "" {
+		return hashed, nil
+	}
+	if len(found) < 2 || !found[1] || legacy.UserID == "" || legacy.SessionID != "" {
+		return nil, apperror.RefreshTokenNotFound
+	}
+
+	return legacy, nil
+}
+
+// migrateRefreshToken gives a refresh token from before sessions existed, stored as just its
+// user and role, a session of its own. The entry is taken with GETDEL, so the token migrates
+// once; having no rotation history, a replay is reported as not found rather than as reuse.
+func (s *serviceImpl) migrateRefreshToken(ctx context.Context, refreshToken string) (*dto.Credentials, error) {
+	refreshCache := &dto.RefreshTokenCache{}
+	err := s.cache.GetDelValue(ctx, refreshKey(refreshToken), refreshCache)
+	if errors.Is(err, redis.Nil) {
+		return nil, apperror.RefreshTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// when the token was issued is unknown, so any revocation of the user or the role still on
+	// record counts as coming after it. The stored role may be stale, but a role change revokes
+	// the user, and cut-offs are kept for longer than the entry can live.
+	if s.revocations.IsRevoked("", refreshCache.UserID, refreshCache.Role, time.Time{}) {
+		s.log.Named("migrateRefreshToken").Info("legacy refresh token of a revoked user or role", zap.String("userId", refreshCache.UserID), zap.String("role", string(refreshCache.Role)))
+		return nil, apperror.SessionExpired
+	}
+
+	now := time.Now()
+	session := &dto.Session{
+		ID:         s.tokenUtils.GetNewUUID().String(),
+		UserID:     refreshCache.UserID,
+		Role:       refreshCache.Role,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	credentials, err := s.issueCredentials(ctx, session, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Named("migrateRefreshToken").Info("legacy refresh token migrated", zap.String("userId", session.UserID), zap.String("sessionId", session.ID))
+
+	return credentials, nil
+}
+
+// isLegacyRefreshToken reports whether the token has the uuid form refresh tokens had before
+// they were hashed. Neither a hash nor a token issued since has it.
+func isLegacyRefreshToken(refreshToken string) bool {
+	_, err := uuid.Parse(refreshToken)
+	return len(refreshToken) == 36 && err == nil
+}
+
+func (s *serviceImpl) hashRefreshToken(refreshToken string) string {
+	mac := hmac.New(sha256.New, []byte(s.jwtService.GetConfig().RefreshTokenKey()))
+	mac.Write([]byte(refreshToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// refreshKey is keyed by the hash of the refresh token, or by the token itself for refresh
+// tokens from before sessions existed.
+func refreshKey(refreshTokenHash string) string {
+	return fmt.Sprintf("refresh:%s", refreshTokenHash)
 }
 
-func createRefreshToken() string {
-	return uuid.New().String()
+func sessionKey(sessionId string) string {
+	return fmt.Sprintf("session:%s", sessionId)
 }
 
-func refreshKey(refreshToken string) string {
-	return fmt.Sprintf("refresh:%s", refreshToken)
+func qrTokenKey(tokenId string) string {
+	return fmt.Sprintf("qr:%s", tokenId)
 }
 
-func sessionKey(userId string) string {
-	return fmt.Sprintf("session:%s", userId)
+func userSessionsKey(userId string) string {
+	return fmt.Sprintf("sessions:%s", userId)
 }
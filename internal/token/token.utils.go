@@ -1,9 +1,17 @@
 package token
 
-import "github.com/google/uuid"
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/google/uuid"
+)
+
+const refreshTokenBytes = 32
 
 type TokenUtils interface {
 	GetNewUUID() *uuid.UUID
+	GenerateRefreshToken() (string, error)
 }
 
 type tokenUtilsImpl struct{}
@@ -16,3 +24,13 @@ func (u *tokenUtilsImpl) GetNewUUID() *uuid.UUID {
 	uuid := uuid.New()
 	return &uuid
 }
+
+// GenerateRefreshToken returns an opaque token with 256 bits of randomness.
+func (u *tokenUtilsImpl) GenerateRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,169 @@
+package token
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	validationCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_validation_cache_hits_total",
+		Help: "Number of access token validations answered from the in-process cache.",
+	})
+	validationCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "auth_validation_cache_misses_total",
+		Help: "Number of access token validations that were not in the in-process cache.",
+	})
+	validationCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "auth_validation_cache_entries",
+		Help: "Number of access tokens in the in-process validation cache.",
+	})
+)
+
+// ValidationCache is a bounded LRU of recently validated access tokens. Entries never outlive
+// the token, and are dropped as soon as their session or user is signed out on this
+// replica; other replicas learn about it through the revocation list.
+type ValidationCache interface {
+	Get(token string) (*dto.UserCredentials, bool)
+	Set(token string, credentials *dto.UserCredentials)
+	InvalidateSession(sessionId string)
+	InvalidateUser(userId string)
+}
+
+type validationCacheEntry struct {
+	token       string
+	credentials *dto.UserCredentials
+	expiresAt   time.Time
+}
+
+type validationCacheImpl struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	sessions map[string]map[string]struct{}
+	users    map[string]map[string]struct{}
+}
+
+// NewValidationCache returns a cache holding at most size tokens for at most ttl seconds. A
+// size of zero disables caching.
+func NewValidationCache(size int, ttl int) ValidationCache {
+	return &validationCacheImpl{
+		size:     size,
+		ttl:      time.Duration(ttl) * time.Second,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		sessions: map[string]map[string]struct{}{},
+		users:    map[string]map[string]struct{}{},
+	}
+}
+
+func (c *validationCacheImpl) Get(token string) (*dto.UserCredentials, bool) {
+	if c.size <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[token]
+	if !ok {
+		validationCacheMisses.Inc()
+		return nil, false
+	}
+
+	entry := elem.Value.(*validationCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(elem)
+		validationCacheMisses.Inc()
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	validationCacheHits.Inc()
+
+	return entry.credentials, true
+}
+
+func (c *validationCacheImpl) Set(token string, credentials *dto.UserCredentials) {
+	if c.size <= 0 {
+		return
+	}
+
+	expiresAt := time.Now().Add(c.ttl)
+	if credentials.ExpiresAt.Before(expiresAt) {
+		expiresAt = credentials.ExpiresAt
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[token]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[token] = c.order.PushFront(&validationCacheEntry{
+		token:       token,
+		credentials: credentials,
+		expiresAt:   expiresAt,
+	})
+	addToIndex(c.sessions, credentials.SessionID, token)
+	addToIndex(c.users, credentials.UserID, token)
+
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+
+	validationCacheSize.Set(float64(c.order.Len()))
+}
+
+func (c *validationCacheImpl) InvalidateSession(sessionId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(c.sessions[sessionId])
+}
+
+func (c *validationCacheImpl) InvalidateUser(userId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.invalidate(c.users[userId])
+}
+
+func (c *validationCacheImpl) invalidate(tokens map[string]struct{}) {
+	for token := range tokens {
+		if elem, ok := c.entries[token]; ok {
+			c.remove(elem)
+		}
+	}
+
+	validationCacheSize.Set(float64(c.order.Len()))
+}
+
+func (c *validationCacheImpl) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*validationCacheEntry)
+	delete(c.entries, entry.token)
+	removeFromIndex(c.sessions, entry.credentials.SessionID, entry.token)
+	removeFromIndex(c.users, entry.credentials.UserID, entry.token)
+}
+
+func addToIndex(index map[string]map[string]struct{}, key string, token string) {
+	if index[key] == nil {
+		index[key] = map[string]struct{}{}
+	}
+	index[key][token] = struct{}{}
+}
+
+func removeFromIndex(index map[string]map[string]struct{}, key string, token string) {
+	delete(index[key], token)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
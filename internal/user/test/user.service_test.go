@@ -1,23 +1,177 @@
 package test
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/isd-sgcu/rpkm67-auth/config"
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/cache"
+	"github.com/isd-sgcu/rpkm67-auth/internal/dto"
+	"github.com/isd-sgcu/rpkm67-auth/internal/jwt"
+	"github.com/isd-sgcu/rpkm67-auth/internal/permission"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
+	"github.com/isd-sgcu/rpkm67-auth/internal/user"
+	mock_permission "github.com/isd-sgcu/rpkm67-auth/mocks/permission"
+	mock_user "github.com/isd-sgcu/rpkm67-auth/mocks/user"
+	proto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/user/v1"
+	"github.com/isd-sgcu/rpkm67-model/constant"
+	"github.com/isd-sgcu/rpkm67-model/model"
 	"github.com/stretchr/testify/suite"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
+// UserServiceTest runs the user service against a mock repository and a real token service on
+// the in-memory cache, so role changes can be checked against issued tokens.
 type UserServiceTest struct {
 	suite.Suite
-	// controller *gomock.Controller
-	// logger     *zap.Logger
+	controller *gomock.Controller
+	repo       *mock_user.MockRepository
+	cache      cache.Repository
+	tokenSvc   token.Service
+	svc        proto.UserServiceServer
+	ctx        context.Context
+	logger     *zap.Logger
 }
 
 func TestUserService(t *testing.T) {
 	suite.Run(t, new(UserServiceTest))
 }
 
-func (t *UserServiceTest) SetupTest() {}
+func (t *UserServiceTest) SetupTest() {
+	t.controller = gomock.NewController(t.T())
+	t.repo = mock_user.NewMockRepository(t.controller)
+	t.ctx = context.Background()
+	t.logger = zap.NewNop()
+
+	conf := config.JwtConfig{
+		Secret:     "secret",
+		AccessTTL:  3600,
+		RefreshTTL: 259200,
+		Issuer:     "issuer",
+	}
+	keys, err := jwt.NewKeyStore(conf)
+	t.Require().NoError(err)
+	codec, err := jwt.NewCodec(conf.TokenFormat, keys, jwt.NewJwtStrategy(keys), jwt.NewJwtUtils())
+	t.Require().NoError(err)
+
+	permissionRepo := mock_permission.NewMockRepository(t.controller)
+	permissionRepo.EXPECT().FindByRole(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+	permissionRepo.EXPECT().FindByUser(gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+	t.cache = cache.NewMemoryRepository(cache.Options{})
+	t.tokenSvc = token.NewService(
+		jwt.NewService(conf, codec, t.logger),
+		permission.NewService(&config.AuthConfig{}, permissionRepo, t.logger),
+		t.cache,
+		token.NewRevocationList(t.cache, conf.RevocationRetention(), t.logger),
+		token.NewValidationCache(0, 0),
+		token.NewTokenUtils(),
+		t.logger,
+	)
+	t.svc = user.NewService(t.repo, t.tokenSvc, t.logger)
+}
+
+func (t *UserServiceTest) login(role constant.Role) *dto.Credentials {
+	credentials, err := t.tokenSvc.CreateCredentials(t.ctx, "user-id", role, &dto.ClientInfo{})
+	t.Require().NoError(err)
+
+	return credentials
+}
+
+func (t *UserServiceTest) expectFindOne(role constant.Role) {
+	t.repo.EXPECT().FindOne("user-id", gomock.Any()).SetArg(1, model.User{Role: role}).Return(nil)
+}
 
 func (t *UserServiceTest) TestSignUpSuccess() {
 
 }
+
+func (t *UserServiceTest) TestUpdateRoleRevokesSessions() {
+	credentials := t.login(constant.STAFF)
+	t.expectFindOne(constant.STAFF)
+	t.repo.EXPECT().Update("user-id", gomock.Any()).Return(nil)
+
+	res, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Role: string(constant.USER)})
+	t.Require().NoError(err)
+	t.True(res.Success)
+
+	_, err = t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.ErrorIs(err, apperror.TokenRevoked)
+	_, err = t.tokenSvc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.ErrorIs(err, apperror.RefreshTokenNotFound)
+
+	// signing in again within the same second gets a token for the new role
+	time.Sleep(2 * time.Millisecond)
+	credentials = t.login(constant.USER)
+	userCredentials, err := t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.Require().NoError(err)
+	t.Equal(constant.USER, userCredentials.Role)
+}
+
+func (t *UserServiceTest) TestUpdateRoleRefusesLegacyRefreshToken() {
+	// a refresh token from before sessions existed, stored as just its user and role
+	legacyToken := uuid.NewString()
+	t.Require().NoError(t.cache.SetValue(t.ctx, "refresh:"+legacyToken, map[string]string{"user_id": "user-id", "role": "staff"}, 60))
+	t.expectFindOne(constant.STAFF)
+	t.repo.EXPECT().Update("user-id", gomock.Any()).Return(nil)
+
+	_, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Role: string(constant.USER)})
+	t.Require().NoError(err)
+
+	_, err = t.tokenSvc.RefreshToken(t.ctx, legacyToken)
+	t.ErrorIs(err, apperror.SessionExpired)
+}
+
+func (t *UserServiceTest) TestUpdateSameRoleKeepsSessions() {
+	credentials := t.login(constant.STAFF)
+	t.expectFindOne(constant.STAFF)
+	t.repo.EXPECT().Update("user-id", gomock.Any()).Return(nil)
+
+	_, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Role: string(constant.STAFF)})
+	t.Require().NoError(err)
+
+	_, err = t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.NoError(err)
+}
+
+func (t *UserServiceTest) TestUpdateWithoutRoleKeepsSessions() {
+	credentials := t.login(constant.USER)
+	t.repo.EXPECT().Update("user-id", gomock.Any()).Return(nil)
+
+	_, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Nickname: "nickname"})
+	t.Require().NoError(err)
+
+	_, err = t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.NoError(err)
+	_, err = t.tokenSvc.RefreshToken(t.ctx, credentials.RefreshToken)
+	t.NoError(err)
+}
+
+func (t *UserServiceTest) TestUpdateRoleUserNotFound() {
+	credentials := t.login(constant.STAFF)
+	t.repo.EXPECT().FindOne("user-id", gomock.Any()).Return(gorm.ErrRecordNotFound)
+
+	_, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Role: string(constant.USER)})
+	t.ErrorIs(err, apperror.UserNotFound)
+
+	_, err = t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.NoError(err)
+}
+
+func (t *UserServiceTest) TestUpdateRoleFailed() {
+	credentials := t.login(constant.STAFF)
+	t.expectFindOne(constant.STAFF)
+	t.repo.EXPECT().Update("user-id", gomock.Any()).Return(gorm.ErrInvalidDB)
+
+	_, err := t.svc.Update(t.ctx, &proto.UpdateUserRequest{Id: "user-id", Role: string(constant.USER)})
+	t.Error(err)
+
+	// the role did not change, so neither do the tokens
+	_, err = t.tokenSvc.ValidateToken(t.ctx, credentials.AccessToken, "")
+	t.NoError(err)
+}
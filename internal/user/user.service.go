@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 
+	"github.com/isd-sgcu/rpkm67-auth/internal/apperror"
+	"github.com/isd-sgcu/rpkm67-auth/internal/token"
 	proto "github.com/isd-sgcu/rpkm67-go-proto/rpkm67/auth/user/v1"
 	"github.com/isd-sgcu/rpkm67-model/constant"
 	"github.com/isd-sgcu/rpkm67-model/model"
@@ -19,14 +21,16 @@ type Service interface {
 
 type serviceImpl struct {
 	proto.UnimplementedUserServiceServer
-	repo Repository
-	log  *zap.Logger
+	repo     Repository
+	tokenSvc token.Service
+	log      *zap.Logger
 }
 
-func NewService(repo Repository, log *zap.Logger) proto.UserServiceServer {
+func NewService(repo Repository, tokenSvc token.Service, log *zap.Logger) proto.UserServiceServer {
 	return &serviceImpl{
-		repo: repo,
-		log:  log,
+		repo:     repo,
+		tokenSvc: tokenSvc,
+		log:      log,
 	}
 }
 
@@ -43,15 +47,15 @@ func (s *serviceImpl) Create(_ context.Context, req *proto.CreateUserRequest) (r
 	if err != nil {
 		s.log.Named("Create").Error("Create: ", zap.Error(err))
 		if errors.Is(err, gorm.ErrDuplicatedKey) {
-			return nil, status.Error(codes.AlreadyExists, "duplicate email")
+			return nil, apperror.DuplicateEmail
 		}
-		return nil, err
+		return nil, apperror.ToStatus(err)
 	}
 
 	err = s.repo.AssignGroup(createUser.ID.String(), &newGroup.ID)
 	if err != nil {
 		s.log.Named("Create").Error("AssignGroup: ", zap.Error(err))
-		return nil, err
+		return nil, apperror.ToStatus(err)
 	}
 	createUser.GroupID = &newGroup.ID
 
@@ -67,9 +71,9 @@ func (s *serviceImpl) FindOne(_ context.Context, req *proto.FindOneUserRequest)
 	if err != nil {
 		s.log.Named("FindOne").Error("FindOne: ", zap.Error(err))
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, status.Error(codes.NotFound, "user not found")
+			return nil, apperror.UserNotFound
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, apperror.ToStatus(err)
 	}
 
 	return &proto.FindOneUserResponse{
@@ -84,9 +88,9 @@ func (s *serviceImpl) FindByEmail(_ context.Context, req *proto.FindByEmailReque
 	if err != nil {
 		s.log.Named("FindByEmail").Error("FindByEmail: ", zap.Error(err))
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, status.Error(codes.NotFound, "user not found")
+			return nil, apperror.UserNotFound
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, apperror.ToStatus(err)
 	}
 
 	return &proto.FindByEmailResponse{
@@ -94,20 +98,41 @@ func (s *serviceImpl) FindByEmail(_ context.Context, req *proto.FindByEmailReque
 	}, nil
 }
 
-func (s *serviceImpl) Update(_ context.Context, req *proto.UpdateUserRequest) (res *proto.UpdateUserResponse, err error) {
+func (s *serviceImpl) Update(ctx context.Context, req *proto.UpdateUserRequest) (res *proto.UpdateUserResponse, err error) {
 	updateUser, err := UpdateRequestToModel(req)
 	if err != nil {
 		s.log.Named("Update").Error("UpdateRequestToModel: ", zap.Error(err))
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	currentUser := &model.User{}
+	if updateUser.Role != "" {
+		err = s.repo.FindOne(req.Id, currentUser)
+		if err != nil {
+			s.log.Named("Update").Error("FindOne: ", zap.Error(err))
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, apperror.UserNotFound
+			}
+			return nil, apperror.ToStatus(err)
+		}
+	}
+
 	err = s.repo.Update(req.Id, updateUser)
 	if err != nil {
 		s.log.Named("Update").Error("Update: ", zap.Error(err))
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, status.Error(codes.NotFound, "user not found")
+			return nil, apperror.UserNotFound
+		}
+		return nil, apperror.ToStatus(err)
+	}
+
+	// tokens carry the role, so the old ones must stop working for the new role to take effect
+	if updateUser.Role != "" && updateUser.Role != currentUser.Role {
+		err = s.tokenSvc.RevokeAllSessions(ctx, req.Id)
+		if err != nil {
+			s.log.Named("Update").Error("RevokeAllSessions: ", zap.Error(err), zap.String("userId", req.Id))
+			return nil, apperror.ToStatus(err)
 		}
-		return nil, err
 	}
 
 	return &proto.UpdateUserResponse{
@@ -0,0 +1,120 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: ./internal/permission/permission.repository.go
+
+// Package mock_permission is a generated GoMock package.
+package mock_permission
+
+import (
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+	permission "github.com/isd-sgcu/rpkm67-auth/internal/permission"
+	constant "github.com/isd-sgcu/rpkm67-model/constant"
+)
+
+// MockRepository is a mock of Repository interface.
+type MockRepository struct {
+	ctrl     *gomock.Controller
+	recorder *MockRepositoryMockRecorder
+}
+
+// MockRepositoryMockRecorder is the mock recorder for MockRepository.
+type MockRepositoryMockRecorder struct {
+	mock *MockRepository
+}
+
+// NewMockRepository creates a new mock instance.
+func NewMockRepository(ctrl *gomock.Controller) *MockRepository {
+	mock := &MockRepository{ctrl: ctrl}
+	mock.recorder = &MockRepositoryMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
+	return m.recorder
+}
+
+// CreateRolePermission mocks base method.
+func (m *MockRepository) CreateRolePermission(permission *permission.RolePermission) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRolePermission", permission)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateRolePermission indicates an expected call of CreateRolePermission.
+func (mr *MockRepositoryMockRecorder) CreateRolePermission(permission interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRolePermission", reflect.TypeOf((*MockRepository)(nil).CreateRolePermission), permission)
+}
+
+// CreateUserPermission mocks base method.
+func (m *MockRepository) CreateUserPermission(permission *permission.UserPermission) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUserPermission", permission)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateUserPermission indicates an expected call of CreateUserPermission.
+func (mr *MockRepositoryMockRecorder) CreateUserPermission(permission interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUserPermission", reflect.TypeOf((*MockRepository)(nil).CreateUserPermission), permission)
+}
+
+// DeleteRolePermission mocks base method.
+func (m *MockRepository) DeleteRolePermission(role constant.Role, permission string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRolePermission", role, permission)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteRolePermission indicates an expected call of DeleteRolePermission.
+func (mr *MockRepositoryMockRecorder) DeleteRolePermission(role, permission interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRolePermission", reflect.TypeOf((*MockRepository)(nil).DeleteRolePermission), role, permission)
+}
+
+// DeleteUserPermission mocks base method.
+func (m *MockRepository) DeleteUserPermission(userId, permission string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUserPermission", userId, permission)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUserPermission indicates an expected call of DeleteUserPermission.
+func (mr *MockRepositoryMockRecorder) DeleteUserPermission(userId, permission interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUserPermission", reflect.TypeOf((*MockRepository)(nil).DeleteUserPermission), userId, permission)
+}
+
+// FindByRole mocks base method.
+func (m *MockRepository) FindByRole(role constant.Role, permissions *[]permission.RolePermission) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindByRole", role, permissions)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FindByRole indicates an expected call of FindByRole.
+func (mr *MockRepositoryMockRecorder) FindByRole(role, permissions interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByRole", reflect.TypeOf((*MockRepository)(nil).FindByRole), role, permissions)
+}
+
+// FindByUser mocks base method.
+func (m *MockRepository) FindByUser(userId string, permissions *[]permission.UserPermission) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindByUser", userId, permissions)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FindByUser indicates an expected call of FindByUser.
+func (mr *MockRepositoryMockRecorder) FindByUser(userId, permissions interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByUser", reflect.TypeOf((*MockRepository)(nil).FindByUser), userId, permissions)
+}
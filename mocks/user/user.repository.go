@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	uuid "github.com/google/uuid"
 	model "github.com/isd-sgcu/rpkm67-model/model"
 )
 
@@ -34,18 +35,32 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
+// AssignGroup mocks base method.
+func (m *MockRepository) AssignGroup(id string, groupID *uuid.UUID) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AssignGroup", id, groupID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AssignGroup indicates an expected call of AssignGroup.
+func (mr *MockRepositoryMockRecorder) AssignGroup(id, groupID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AssignGroup", reflect.TypeOf((*MockRepository)(nil).AssignGroup), id, groupID)
+}
+
 // Create mocks base method.
-func (m *MockRepository) Create(user *model.User) error {
+func (m *MockRepository) Create(user *model.User, stamp *model.Stamp, group *model.Group) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Create", user)
+	ret := m.ctrl.Call(m, "Create", user, stamp, group)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Create indicates an expected call of Create.
-func (mr *MockRepositoryMockRecorder) Create(user interface{}) *gomock.Call {
+func (mr *MockRepositoryMockRecorder) Create(user, stamp, group interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockRepository)(nil).Create), user)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockRepository)(nil).Create), user, stamp, group)
 }
 
 // FindByEmail mocks base method.